@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	ErrQueueNotFound   = errors.New("queue not found")
+	ErrMessageNotFound = errors.New("message not found")
+	ErrNotSaved        = errors.New("message could not be saved")
+	ErrLeaseLost       = errors.New("message is not leased by this receipt")
+	ErrBusy            = errors.New("too many requests are waiting")
+	ErrInvalidName     = errors.New("file is not named queue:id")
+	ErrNotSupported    = errors.New("not supported by this backend")
+	ErrStorageChanged  = errors.New("queue storage cannot be changed")
+)
+
+// The prefix of a root selecting the SQLite backend, as in sqlite:///var/mq.db.
+// Only available when built with the sqlite tag.
+const SqliteScheme = "sqlite://"
+
+// A message's content is never held in memory. When saving, Body is read
+// until it ends. When fetched or opened, Body reads the stored content and
+// must be closed by the caller. Size is -1 when unknown.
+//
+// A fetched message carries the Receipt of the lease it was fetched under.
+// Every fetch of the same message leases it anew, with a different receipt.
+type Message struct {
+	Id      string
+	Size    int64
+	Body    io.ReadCloser
+	Receipt string
+}
+
+// Reads from the underlying reader until the context is done, at which point
+// every read fails with the context's error. Lets a backend stop reading a
+// message for a request which was given up on.
+type ContextReader struct {
+	Context context.Context
+	Reader  io.Reader
+}
+
+func (reader *ContextReader) Read(p []byte) (int, error) {
+	if err := reader.Context.Err(); err != nil {
+		return 0, err
+	}
+
+	return reader.Reader.Read(p)
+}
+
+// The replays of a backend which retains nothing once deleted.
+type Unretained struct{}
+
+func (unretained Unretained) ReplayMessage(ctx context.Context, queue *Queue, message *Message) error {
+	return ErrNotSupported
+}
+
+func (unretained Unretained) ReplayMessages(ctx context.Context, queue *Queue, from time.Time, to time.Time) (int, error) {
+	return 0, ErrNotSupported
+}
+
+// Where queues and their messages are kept. The endpoints only ever talk to
+// a Backend, so any implementation keeping the same lifecycle (saved, fetched
+// and hidden for a while, then either deleted or re-delivered) can stand in
+// for the file system.
+//
+// Every call takes the context of the request it serves. A call whose
+// context is done before it completes is abandoned where it safely can be,
+// and fails with the context's error.
+type Backend interface {
+	// Creates a queue, or replaces its attributes when it has any.
+	SaveQueue(ctx context.Context, queue *Queue) error
+
+	// Fills in the attributes of an existing queue.
+	FetchQueue(ctx context.Context, queue *Queue) error
+
+	// Deletes a queue along with all of its messages.
+	DeleteQueue(ctx context.Context, queue *Queue) error
+
+	// Stores a new message, checking it against the server's and the
+	// queue's limits first. Returns ErrBusy when it can't be done in time,
+	// or the context's error once it is done.
+	SaveMessage(ctx context.Context, queue *Queue, message *Message) error
+
+	// Leases the next message of a queue, hiding it until it is deleted or
+	// its lease runs out. Returns nil without an error when there is none,
+	// and fails like SaveMessage.
+	FetchMessage(ctx context.Context, queue *Queue) (*Message, error)
+
+	// Ends the lease of a fetched message, making it available right away.
+	// Returns ErrLeaseLost unless the message's receipt is of its current
+	// lease.
+	ReleaseMessage(ctx context.Context, queue *Queue, message *Message) error
+
+	// Makes the lease of a fetched message run out after the given time from
+	// now, replacing the message's receipt with the one of the new lease.
+	// Returns ErrLeaseLost unless the message's receipt is of its current
+	// lease.
+	ExtendMessage(ctx context.Context, queue *Queue, message *Message, visibility time.Duration) error
+
+	// Deletes a message, wherever it is in its lifecycle. A leased message
+	// is only deleted given the receipt of its current lease, and a receipt
+	// only deletes the message while that lease is current. Otherwise
+	// ErrLeaseLost is returned and the message is left alone.
+	DeleteMessage(ctx context.Context, queue *Queue, message *Message) error
+
+	// Puts a deleted message back in its queue, for as long as it is
+	// retained. Returns ErrMessageNotFound once it isn't, and
+	// ErrNotSupported from a backend which retains nothing.
+	ReplayMessage(ctx context.Context, queue *Queue, message *Message) error
+
+	// Replays every retained message of a queue created from one time up to
+	// another, as told by its ID. A zero time leaves that end open. Returns
+	// how many were replayed, even when it fails part way.
+	ReplayMessages(ctx context.Context, queue *Queue, from time.Time, to time.Time) (int, error)
+
+	// Lists the IDs of the messages waiting in a queue.
+	ListMessages(ctx context.Context, queue *Queue) ([]string, error)
+
+	// Looks up the size of a message, wherever it is in its lifecycle.
+	StatMessage(ctx context.Context, queue *Queue, message *Message) (*Message, error)
+
+	// Opens a message for reading without leasing it.
+	OpenMessage(ctx context.Context, queue *Queue, message *Message) (*Message, error)
+
+	// Waits for the work in progress, up to the context's deadline. Returns
+	// false when it had to be abandoned.
+	Close(ctx context.Context) bool
+}
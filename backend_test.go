@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"github.com/softlayer/mq/spool"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// A backend every Backend test runs against, set up afresh for each with the
+// given peers and limits.
+type testBackend struct {
+	Name  string
+	Setup func(t *testing.T, peers int, limits Limits) Backend
+}
+
+// The sqlite backend adds itself when it is built.
+var testBackends = []testBackend{
+	{"memory", func(t *testing.T, peers int, limits Limits) Backend {
+		store := setupMemory()
+		store.Peers = peers
+		store.Limits = limits
+
+		return store
+	}},
+	{"log", func(t *testing.T, peers int, limits Limits) Backend {
+		store := setupLog(t.TempDir())
+		store.Peers = peers
+		store.Limits = limits
+		t.Cleanup(func() { store.Close(context.Background()) })
+
+		return store
+	}},
+	{"file", func(t *testing.T, peers int, limits Limits) Backend {
+		store := NewStore(testWorkers, peers, t.TempDir())
+		store.Visibility = time.Minute
+		store.Strict = true
+		store.Limits = limits
+
+		store.PrepareFolders()
+		store.PrepareWorkers()
+		store.PrepareMover()
+		t.Cleanup(func() { store.Close(context.Background()) })
+
+		return store
+	}},
+}
+
+func setupMemory() *MemoryStore {
+	store := NewMemoryStore(testPeers)
+	store.Visibility = time.Minute
+
+	return store
+}
+
+// Runs a test against every backend, each set up with the given peers and
+// limits.
+func eachBackend(t *testing.T, peers int, limits Limits, test func(t *testing.T, store Backend)) {
+	for _, backend := range testBackends {
+		t.Run(backend.Name, func(t *testing.T) {
+			test(t, backend.Setup(t, peers, limits))
+		})
+	}
+}
+
+// Fetches the next message of a queue, waiting up to a few seconds for one,
+// as the file store's mover delivers new messages a moment after they are
+// saved.
+func fetchWithin(ctx context.Context, store Backend, queue *Queue) *Message {
+	for i := 0; i < 300; i++ {
+		if fetched, _ := store.FetchMessage(ctx, queue); fetched != nil {
+			return fetched
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return nil
+}
+
+// Waits until the given number of messages are waiting in a queue.
+func waitListed(ctx context.Context, store Backend, queue *Queue, count int) bool {
+	for i := 0; i < 300; i++ {
+		if messageIds, _ := store.ListMessages(ctx, queue); len(messageIds) == count {
+			return true
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return false
+}
+
+func readBody(message *Message) string {
+	content, _ := ioutil.ReadAll(message.Body)
+	message.Body.Close()
+
+	return string(content)
+}
+
+func TestBackendMessageLifecycle(t *testing.T) {
+	eachBackend(t, testPeers, Limits{}, func(t *testing.T, store Backend) {
+		ctx := context.Background()
+
+		queue := &Queue{Id: queueId}
+		message := newMessage(messageId, messageContent)
+
+		if store.SaveMessage(ctx, queue, message) != ErrQueueNotFound {
+			t.Error("Saved a message to a queue which doesn't exist")
+		}
+
+		store.SaveQueue(ctx, queue)
+
+		if store.SaveMessage(ctx, queue, newMessage(messageId, messageContent)) != nil {
+			t.Error("Could not save message")
+		}
+
+		fetched := fetchWithin(ctx, store, queue)
+
+		if fetched == nil || fetched.Id != messageId {
+			t.Fatal("Unable to fetch correct message")
+		}
+
+		if readBody(fetched) != string(messageContent) {
+			t.Error("Fetched message with incorrect content")
+		}
+
+		// While leased, the message is hidden from other fetches but can
+		// still be opened by its ID.
+		if again, _ := store.FetchMessage(ctx, queue); again != nil {
+			t.Error("Fetched a leased message")
+		}
+
+		if opened, err := store.OpenMessage(ctx, queue, message); err != nil {
+			t.Error("Could not open a leased message")
+		} else {
+			opened.Body.Close()
+		}
+
+		if store.ReleaseMessage(ctx, queue, message) != ErrLeaseLost {
+			t.Error("Released a leased message without its receipt")
+		}
+
+		receipt := fetched.Receipt
+
+		if store.ExtendMessage(ctx, queue, fetched, time.Hour) != nil || fetched.Receipt == receipt {
+			t.Error("Could not extend lease")
+		}
+
+		if store.ReleaseMessage(ctx, queue, fetched) != nil {
+			t.Error("Could not release message")
+		}
+
+		if fetched = fetchWithin(ctx, store, queue); fetched == nil {
+			t.Fatal("Could not fetch message after releasing it")
+		}
+
+		fetched.Body.Close()
+
+		if store.DeleteMessage(ctx, queue, message) != ErrLeaseLost {
+			t.Error("Deleted a leased message without its receipt")
+		}
+
+		if store.DeleteMessage(ctx, queue, fetched) != nil {
+			t.Error("Could not delete message")
+		}
+
+		if _, err := store.StatMessage(ctx, queue, message); err != ErrMessageNotFound {
+			t.Error("Found message after deleting it")
+		}
+	})
+}
+
+func TestBackendRedelivery(t *testing.T) {
+	eachBackend(t, testPeers, Limits{}, func(t *testing.T, store Backend) {
+		ctx := context.Background()
+
+		queue := &Queue{Id: queueId, Config: &QueueConfig{VisibilityTimeout: 1}}
+		store.SaveQueue(ctx, queue)
+		store.SaveMessage(ctx, queue, newMessage(messageId, messageContent))
+
+		fetched := fetchWithin(ctx, store, queue)
+
+		if fetched == nil {
+			t.Fatal("Could not fetch message")
+		}
+
+		fetched.Body.Close()
+
+		if again, _ := store.FetchMessage(ctx, queue); again != nil {
+			t.Error("Fetched a message before its lease ran out")
+		}
+
+		// The queue's visibility timeout overrides the backend's minute.
+		if fetched = fetchWithin(ctx, store, queue); fetched == nil || fetched.Id != messageId {
+			t.Fatal("Message wasn't re-delivered after its lease ran out")
+		}
+
+		fetched.Body.Close()
+	})
+}
+
+func TestBackendDeadLetters(t *testing.T) {
+	eachBackend(t, testPeers, Limits{}, func(t *testing.T, store Backend) {
+		ctx := context.Background()
+
+		deadLetterQueue := &Queue{Id: "dead"}
+		queue := &Queue{Id: queueId, Config: &QueueConfig{MaxReceiveCount: 1, DeadLetterQueue: deadLetterQueue.Id}}
+
+		store.SaveQueue(ctx, deadLetterQueue)
+		store.SaveQueue(ctx, queue)
+		store.SaveMessage(ctx, queue, newMessage(messageId, messageContent))
+
+		fetched := fetchWithin(ctx, store, queue)
+
+		if fetched == nil {
+			t.Fatal("Could not fetch message")
+		}
+
+		fetched.Body.Close()
+		store.ReleaseMessage(ctx, queue, fetched)
+
+		// A second delivery is one too many.
+		if fetched, _ = store.FetchMessage(ctx, queue); fetched != nil {
+			t.Error("Delivered a message beyond its receive count")
+		}
+
+		if fetched = fetchWithin(ctx, store, deadLetterQueue); fetched == nil || fetched.Id != messageId {
+			t.Fatal("Message wasn't moved to the dead letter queue")
+		}
+
+		if readBody(fetched) != string(messageContent) {
+			t.Error("Dead letter has incorrect content")
+		}
+	})
+}
+
+func TestBackendMissingDeadLetterQueue(t *testing.T) {
+	eachBackend(t, testPeers, Limits{}, func(t *testing.T, store Backend) {
+		ctx := context.Background()
+
+		queue := &Queue{Id: queueId, Config: &QueueConfig{MaxReceiveCount: 1, DeadLetterQueue: "dead"}}
+		message := newMessage(messageId, messageContent)
+
+		store.SaveQueue(ctx, queue)
+		store.SaveMessage(ctx, queue, message)
+
+		fetched := fetchWithin(ctx, store, queue)
+
+		if fetched == nil {
+			t.Fatal("Could not fetch message")
+		}
+
+		fetched.Body.Close()
+		store.ReleaseMessage(ctx, queue, fetched)
+
+		// Without its dead letter queue, the message is dropped instead.
+		if fetched, _ = store.FetchMessage(ctx, queue); fetched != nil {
+			t.Error("Delivered a message beyond its receive count")
+		}
+
+		if _, err := store.StatMessage(ctx, queue, message); err != ErrMessageNotFound {
+			t.Error("Kept a message whose dead letter queue doesn't exist")
+		}
+	})
+}
+
+func TestBackendFifo(t *testing.T) {
+	eachBackend(t, 8, Limits{}, func(t *testing.T, store Backend) {
+		ctx := context.Background()
+
+		queue := &Queue{Id: queueId, Config: &QueueConfig{Fifo: true}}
+		store.SaveQueue(ctx, queue)
+
+		var messageIds []string
+
+		for i := 0; i < 8; i++ {
+			messageIds = append(messageIds, spool.TimeUUID())
+		}
+
+		// Saved out of order, fetched in order regardless of peers.
+		for i := len(messageIds) - 1; i >= 0; i-- {
+			store.SaveMessage(ctx, queue, newMessage(messageIds[i], messageContent))
+		}
+
+		if !waitListed(ctx, store, queue, len(messageIds)) {
+			t.Fatal("Saved messages aren't waiting in the queue")
+		}
+
+		for _, messageId := range messageIds {
+			fetched, _ := store.FetchMessage(ctx, queue)
+
+			if fetched == nil || fetched.Id != messageId {
+				t.Fatal("Fetched messages out of order")
+			}
+
+			fetched.Body.Close()
+		}
+	})
+}
+
+func TestBackendLimits(t *testing.T) {
+	eachBackend(t, testPeers, Limits{MaxQueueMessages: 1}, func(t *testing.T, store Backend) {
+		ctx := context.Background()
+
+		queue := &Queue{Id: queueId, Config: &QueueConfig{MaxMessageSize: int64(len(messageContent)) - 1}}
+		store.SaveQueue(ctx, queue)
+
+		message := newMessage(spool.TimeUUID(), messageContent)
+		message.Size = -1
+
+		if store.SaveMessage(ctx, queue, message) != ErrMessageTooLarge {
+			t.Error("Saved a message of unknown size larger than the queue allows")
+		}
+
+		if store.SaveMessage(ctx, queue, newMessage(spool.TimeUUID(), nil)) != nil {
+			t.Error("Could not save a message within limits")
+		}
+
+		if store.SaveMessage(ctx, queue, newMessage(spool.TimeUUID(), nil)) != ErrQueueFull {
+			t.Error("Saved a message beyond the server's message limit")
+		}
+	})
+}
@@ -2,41 +2,140 @@ package main
 
 import (
 	"flag"
+	"github.com/softlayer/mq/spool"
 	"log"
 	"os"
 	"path"
-	"strings"
+	"strconv"
+	"time"
 )
 
 var (
 	source      string
 	destination string
-	delay       int
+	invalid     string
+	delay       = Delay(0)
+	shard       time.Duration
+	durability  string
+	sweep       time.Duration
+	report      time.Duration
 )
 
+// What became of the files taken from the source: delivered to their queues,
+// quarantined for not being named queue:id, gone before they could be moved,
+// and failed to be moved.
+type Moves struct {
+	Delivered   int
+	Quarantined int
+	Vanished    int
+	Failed      int
+}
+
+// A duration flag which, as --delay always has, reads a bare number as
+// milliseconds.
+type Delay time.Duration
+
+func (delay *Delay) String() string {
+	return time.Duration(*delay).String()
+}
+
+func (delay *Delay) Set(value string) error {
+	if milliseconds, err := strconv.Atoi(value); err == nil {
+		*delay = Delay(time.Duration(milliseconds) * time.Millisecond)
+		return nil
+	}
+
+	duration, err := time.ParseDuration(value)
+
+	if err != nil {
+		return err
+	}
+
+	*delay = Delay(duration)
+
+	return nil
+}
+
 func init() {
 	flag.StringVar(&source, "source", "/tmp/mq/new", "Source for messages to be moved")
 	flag.StringVar(&destination, "destination", "/tmp/mq/queues", "Destination for moved messages")
-	flag.IntVar(&delay, "delay", 0, "Delay in milliseconds to wait before moving a message")
+	flag.StringVar(&invalid, "invalid", "/tmp/mq/invalid", "Folder to quarantine files not named queue:id in")
+	flag.Var(&delay, "delay", "Delay to wait before moving a message, such as 30s, or a number of milliseconds")
+	flag.DurationVar(&shard, "shard", 0, "Interval to bucket queue folders by, as set on mq")
+	flag.DurationVar(&sweep, "sweep", time.Minute, "Interval to sweep the source for files missed at, 0 for never")
+	flag.DurationVar(&report, "report", time.Minute, "Interval to log what was moved at, if anything was, 0 for never")
+	flag.StringVar(&durability, "durability", "strict", "Flush folders after every move (strict) or leave it to the system (relaxed)")
 	flag.Parse()
+
+	if durability != "strict" && durability != "relaxed" {
+		log.Fatal("Unknown durability ", durability)
+	}
 }
 
 func main() {
-	watch := &Watch{
-		Delay:     delay,
+	// Made up front, as mq does, rather than when the first file needs it.
+	if err := os.MkdirAll(invalid, 0777); err != nil {
+		log.Fatal(err)
+	}
+
+	watch := &spool.Watch{
+		Delay:     time.Duration(delay),
+		Sweep:     sweep,
 		Directory: source,
 	}
 
-	watch.Run()
+	if err := watch.Run(); err != nil {
+		log.Fatal(err)
+	}
 
-	for file := range watch.Files {
-		base := path.Base(file)
-		pieces := strings.Split(base, ":")
+	log.Print(source)
 
-		err := os.Rename(path.Join(source, base), path.Join(destination, pieces[0], pieces[1]))
+	var moves, reported Moves
+	var reports <-chan time.Time
 
-		if err != nil {
-			log.Print(err)
+	if report > 0 {
+		reports = time.NewTicker(report).C
+	}
+
+	for {
+		select {
+		case file := <-watch.Files:
+			Move(file, &moves)
+		case <-reports:
+			if moves != reported {
+				log.Printf("Moved %s: %d delivered, %d quarantined, %d vanished, %d failed",
+					source, moves.Delivered, moves.Quarantined, moves.Vanished, moves.Failed)
+				reported = moves
+			}
 		}
 	}
 }
+
+// Delivers a file to its queue, or quarantines it if it isn't named queue:id,
+// and counts what became of it.
+func Move(file string, moves *Moves) {
+	strict := durability == "strict"
+	base := path.Base(file)
+	queueId, messageId, ok := spool.ParseMessageFile(base)
+
+	var err error
+
+	if ok {
+		err = spool.Deliver(path.Join(source, base), destination, queueId, messageId, shard, strict)
+	} else {
+		log.Print("Quarantining ", file, ", which is not named queue:id")
+		err = spool.Rename(path.Join(source, base), path.Join(invalid, base), strict)
+	}
+
+	switch {
+	case err == nil && ok:
+		moves.Delivered += 1
+	case err == nil:
+		moves.Quarantined += 1
+	case os.IsNotExist(err):
+		moves.Vanished += 1
+	default:
+		log.Print(err)
+		moves.Failed += 1
+	}
+}
@@ -2,25 +2,53 @@ package main
 
 import (
 	"flag"
+	"github.com/softlayer/mq/spool"
 	"log"
 	"os"
+	"time"
 )
 
 var (
-	source string
+	source      string
+	sweep       time.Duration
+	retain      time.Duration
+	retainBytes int64
+	prune       time.Duration
 )
 
 func init() {
 	flag.StringVar(&source, "source", "/tmp/mq/remove", "Source for messages to be removed")
+	flag.DurationVar(&sweep, "sweep", time.Minute, "Interval to sweep the source for files missed at, 0 for never")
+	flag.DurationVar(&retain, "retain", 0, "Time to keep removed messages for replay, 0 for none")
+	flag.Int64Var(&retainBytes, "retain-bytes", 0, "Most bytes of removed messages to keep for replay, 0 for unlimited")
+	flag.DurationVar(&prune, "prune", time.Minute, "Interval to unlink retained messages beyond --retain and --retain-bytes at")
 	flag.Parse()
+
+	if prune <= 0 {
+		log.Fatal("Prune interval must be positive")
+	}
 }
 
 func main() {
-	watch := &Watch{
+	// Retained messages are only ever unlinked by age or size, so there is
+	// nothing to watch for.
+	if retain > 0 || retainBytes > 0 {
+		for {
+			Prune()
+			time.Sleep(prune)
+		}
+	}
+
+	watch := &spool.Watch{
+		Sweep:     sweep,
 		Directory: source,
 	}
 
-	watch.Run()
+	if err := watch.Run(); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Print(source)
 
 	for file := range watch.Files {
 		err := os.Remove(file)
@@ -30,3 +58,12 @@ func main() {
 		}
 	}
 }
+
+// Unlinks retained messages beyond --retain and --retain-bytes.
+func Prune() {
+	spool.Prune(source, retain, retainBytes, func(file string) {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			log.Print(err)
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"github.com/softlayer/mq/spool"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	queues string
+	shard  time.Duration
+)
+
+func init() {
+	flag.StringVar(&queues, "queues", "/tmp/mq/queues", "Folder holding the queues to migrate")
+	flag.DurationVar(&shard, "shard", time.Hour, "Interval to bucket queue folders by, or 0 to flatten them")
+	flag.Parse()
+}
+
+// Moves every message of every queue to where the given sharding expects it,
+// whether it is in the queue's folder or in a bucket, then removes the buckets
+// left empty. Meant to be run while mq and its movers are stopped.
+func main() {
+	queueInfos, err := ioutil.ReadDir(queues)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	moved := 0
+
+	for _, queueInfo := range queueInfos {
+		if !queueInfo.IsDir() {
+			continue
+		}
+
+		queueId := queueInfo.Name()
+		queuePath := path.Join(queues, queueId)
+		infos, err := ioutil.ReadDir(queuePath)
+
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		for _, info := range infos {
+			name := info.Name()
+
+			if strings.HasPrefix(name, ".") {
+				continue
+			}
+
+			if !info.IsDir() {
+				moved += Migrate(queuePath, queueId, name)
+				continue
+			}
+
+			bucketPath := path.Join(queuePath, name)
+			messageInfos, err := ioutil.ReadDir(bucketPath)
+
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+
+			for _, messageInfo := range messageInfos {
+				if !messageInfo.IsDir() && !strings.HasPrefix(messageInfo.Name(), ".") {
+					moved += Migrate(bucketPath, queueId, messageInfo.Name())
+				}
+			}
+
+			// Only removed if nothing was left in it.
+			os.Remove(bucketPath)
+		}
+	}
+
+	log.Printf("Migrated %d messages in %s to a shard of %s", moved, queues, shard)
+}
+
+// Moves a message from the given folder to its place in its queue, returning
+// how many messages were moved.
+func Migrate(folder string, queueId string, messageId string) int {
+	source := path.Join(folder, messageId)
+	if source == spool.QueuePath(queues, queueId, messageId, shard) {
+		return 0
+	}
+
+	if err := spool.Deliver(source, queues, queueId, messageId, shard, true); err != nil {
+		log.Print(err)
+		return 0
+	}
+
+	return 1
+}
@@ -1,5 +1,18 @@
 #!/bin/bash
 
-go build -o build/mq        mq.go route.go endpoint.go store.go uuid.go
-go build -o build/mq-mover  bin/mover.go bin/watch.go
-go build -o build/mq-reaper bin/reaper.go bin/watch.go
\ No newline at end of file
+# mq and its tools share the spool package, imported as
+# github.com/softlayer/mq/spool, so the checkout must sit at that path in
+# $GOPATH.
+
+# Set SQLITE=1 to build mq with the SQLite backend.
+if [ -n "$SQLITE" ]; then
+    tags="-tags sqlite"
+    sqlite=sqlite.go
+else
+    sqlite=nosqlite.go
+fi
+
+go build $tags -o build/mq        mq.go route.go endpoint.go backend.go store.go queue.go limit.go recover.go memory.go log.go $sqlite shard.go index.go mover.go
+go build -o build/mq-mover  bin/mover.go
+go build -o build/mq-reaper bin/reaper.go
+go build -o build/mq-shard  bin/shard.go
@@ -1,81 +1,339 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/softlayer/mq/spool"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func GetQueue(session *Session) {
 	queue := &Queue{Id: session.Match.Variables["queue"]}
 
-	if session.Store.FetchQueue(queue) != nil {
+	if session.Store.FetchQueue(session.Request.Context(), queue) == nil {
+		content, _ := json.Marshal(queue.Config)
+
+		session.Response.Header().Set("Content-Type", "application/json")
 		session.Response.WriteHeader(http.StatusOK)
+		session.Response.Write(content)
 		return
 	}
 
 	session.Response.WriteHeader(http.StatusNotFound)
 }
 
+// Queue attributes are a handful of fields, so a larger body is refused
+// rather than read into memory.
+const MaxQueueConfigSize = 64 << 10
+
 func CreateQueue(session *Session) {
 	queue := &Queue{Id: session.Match.Variables["queue"]}
 
-	session.Store.SaveQueue(queue)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(session.Response, session.Request.Body, MaxQueueConfigSize))
+
+	if _, tooLarge := err.(*http.MaxBytesError); tooLarge {
+		session.Response.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if err != nil {
+		session.Response.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// An empty body creates the queue, or leaves an existing one as it is.
+	// Otherwise, the body holds the full set of the queue's attributes.
+	if len(body) > 0 {
+		queue.Config = &QueueConfig{}
+
+		if json.Unmarshal(body, queue.Config) != nil || !queue.Config.Valid(queue) {
+			session.Response.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = session.Store.SaveQueue(session.Request.Context(), queue)
+
+	if err == ErrStorageChanged {
+		session.Response.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	if err != nil {
+		session.Response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	session.Response.WriteHeader(http.StatusCreated)
 }
 
 func DeleteQueue(session *Session) {
 	queue := &Queue{Id: session.Match.Variables["queue"]}
 
-	session.Store.DeleteQueue(queue)
+	session.Store.DeleteQueue(session.Request.Context(), queue)
 	session.Response.WriteHeader(http.StatusOK)
 }
 
 func GetMessage(session *Session) {
 	queue := &Queue{Id: session.Match.Variables["queue"]}
 
-	message := session.Store.FetchMessage(queue)
+	message, err := session.Store.FetchMessage(session.Request.Context(), queue)
 
-	if message != nil {
-		session.Response.Header().Set("X-Message-Id", message.Id)
-		session.Response.WriteHeader(http.StatusOK)
-		session.Response.Write(message.Content)
+	if err == nil && message != nil {
+		session.Response.Header().Set("X-Receipt-Handle", ReceiptHandle(message))
+		ServeMessage(session, message)
+		return
+	}
+
+	if err == ErrBusy {
+		Busy(session)
 		return
 	}
 
 	session.Response.WriteHeader(http.StatusNoContent)
 }
 
-func CreateMessage(session *Session) {
+// Answers a request the workers were too busy to take in time.
+func Busy(session *Session) {
+	session.Response.Header().Set("Retry-After", "1")
+	session.Response.WriteHeader(http.StatusServiceUnavailable)
+}
+
+func PeekMessage(session *Session) {
 	queue := &Queue{Id: session.Match.Variables["queue"]}
+	message := &Message{Id: session.Match.Variables["message"]}
 
-	body, err := ioutil.ReadAll(session.Request.Body)
+	message, err := session.Store.OpenMessage(session.Request.Context(), queue, message)
 
-	if err != nil {
-		session.Response.WriteHeader(http.StatusBadRequest)
+	if err == nil {
+		ServeMessage(session, message)
+		return
+	}
+
+	session.Response.WriteHeader(http.StatusNotFound)
+}
+
+// Writes a message's content as the response, and closes it. A message is
+// never rewritten, so its ID is all the ETag needs to be, and a client can
+// resume a partial download with Range and If-Range.
+func ServeMessage(session *Session, message *Message) {
+	defer message.Body.Close()
+
+	session.Response.Header().Set("X-Message-Id", message.Id)
+	session.Response.Header().Set("ETag", `"`+message.Id+`"`)
+
+	if content, ok := message.Body.(io.ReadSeeker); ok {
+		http.ServeContent(session.Response, session.Request, "", time.Time{}, content)
 		return
 	}
 
+	session.Response.Header().Set("Content-Length", strconv.FormatInt(message.Size, 10))
+	session.Response.WriteHeader(http.StatusOK)
+	io.Copy(session.Response, message.Body)
+}
+
+func CreateMessage(session *Session) {
+	queue := &Queue{Id: session.Match.Variables["queue"]}
+
+	// The store refuses a message it knows is too large before reading
+	// any of it. Anything else is streamed to disk, and stopped if it turns
+	// out to be too large.
 	message := &Message{
-		Id:      TimeUUID(),
-		Content: body,
+		Id:   spool.TimeUUID(),
+		Size: session.Request.ContentLength,
+		Body: session.Request.Body,
 	}
 
-	success := session.Store.SaveMessage(queue, message)
+	err := session.Store.SaveMessage(session.Request.Context(), queue, message)
 
-	if success {
+	switch err {
+	case nil:
 		session.Response.Header().Set("X-Message-Id", message.Id)
 		session.Response.WriteHeader(http.StatusCreated)
+	case ErrQueueNotFound:
+		session.Response.WriteHeader(http.StatusNotFound)
+	case ErrMessageTooLarge:
+		session.Response.WriteHeader(http.StatusRequestEntityTooLarge)
+	case ErrQueueFull:
+		session.Response.Header().Set("Retry-After", "10")
+		session.Response.WriteHeader(http.StatusTooManyRequests)
+	case ErrQueueTooLarge:
+		session.Response.Header().Set("Retry-After", "10")
+		session.Response.WriteHeader(http.StatusInsufficientStorage)
+	case ErrBusy:
+		Busy(session)
+	default:
+		session.Response.Header().Set("Retry-After", "10")
+		session.Response.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+func DeleteMessage(session *Session) {
+	queue := &Queue{Id: session.Match.Variables["queue"]}
+	message := &Message{Id: session.Match.Variables["message"]}
+
+	// Messages which were never fetched are deleted without a receipt
+	// handle.
+	if session.Request.Header.Get("X-Receipt-Handle") != "" && !ReadReceiptHandle(session, message) {
 		return
 	}
 
-	session.Response.Header().Set("Retry-After", "10")
-	session.Response.WriteHeader(http.StatusServiceUnavailable)
+	// A message leased by somebody else, or whose lease ran out, is left
+	// alone. Anything else is as good as deleted.
+	switch session.Store.DeleteMessage(session.Request.Context(), queue, message) {
+	case ErrLeaseLost:
+		session.Response.WriteHeader(http.StatusConflict)
+	case ErrBusy:
+		Busy(session)
+	default:
+		session.Response.WriteHeader(http.StatusAccepted)
+	}
 }
 
-func DeleteMessage(session *Session) {
+func ExtendLease(session *Session) {
+	queue := &Queue{Id: session.Match.Variables["queue"]}
+	message := &Message{Id: session.Match.Variables["message"]}
+
+	if !ReadReceiptHandle(session, message) {
+		return
+	}
+
+	seconds, err := strconv.Atoi(session.Request.Header.Get("X-Visibility-Timeout"))
+
+	if err != nil || seconds <= 0 {
+		session.Response.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = session.Store.ExtendMessage(session.Request.Context(), queue, message, time.Duration(seconds)*time.Second)
+
+	if err == ErrBusy {
+		Busy(session)
+		return
+	}
+
+	if err != nil {
+		session.Response.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	session.Response.Header().Set("X-Receipt-Handle", ReceiptHandle(message))
+	session.Response.WriteHeader(http.StatusOK)
+}
+
+func ReleaseLease(session *Session) {
 	queue := &Queue{Id: session.Match.Variables["queue"]}
 	message := &Message{Id: session.Match.Variables["message"]}
 
-	session.Store.DeleteMessage(queue, message)
-	session.Response.WriteHeader(http.StatusAccepted)
+	if !ReadReceiptHandle(session, message) {
+		return
+	}
+
+	err := session.Store.ReleaseMessage(session.Request.Context(), queue, message)
+
+	if err == ErrBusy {
+		Busy(session)
+		return
+	}
+
+	if err != nil {
+		session.Response.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	session.Response.WriteHeader(http.StatusOK)
+}
+
+func ReplayMessage(session *Session) {
+	queue := &Queue{Id: session.Match.Variables["queue"]}
+	message := &Message{Id: session.Match.Variables["message"]}
+
+	switch session.Store.ReplayMessage(session.Request.Context(), queue, message) {
+	case nil:
+		session.Response.WriteHeader(http.StatusOK)
+	case ErrNotSupported:
+		session.Response.WriteHeader(http.StatusNotImplemented)
+	case ErrQueueNotFound, ErrMessageNotFound:
+		session.Response.WriteHeader(http.StatusNotFound)
+	default:
+		session.Response.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// Replays the retained messages of a queue created within the range given by
+// the from and to parameters, both RFC 3339 times and both optional.
+func ReplayMessages(session *Session) {
+	queue := &Queue{Id: session.Match.Variables["queue"]}
+	query := session.Request.URL.Query()
+
+	var from, to time.Time
+
+	for name, bound := range map[string]*time.Time{"from": &from, "to": &to} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+
+			if err != nil {
+				session.Response.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			*bound = parsed
+		}
+	}
+
+	if !to.IsZero() && !from.Before(to) {
+		session.Response.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	replayed, err := session.Store.ReplayMessages(session.Request.Context(), queue, from, to)
+
+	switch err {
+	case ErrNotSupported:
+		session.Response.WriteHeader(http.StatusNotImplemented)
+	case ErrQueueNotFound:
+		session.Response.WriteHeader(http.StatusNotFound)
+	default:
+		// Messages replayed before a failure stay replayed, so the count
+		// is reported either way.
+		status := http.StatusOK
+
+		if err != nil {
+			status = http.StatusInternalServerError
+		}
+
+		content, _ := json.Marshal(map[string]int{"replayed": replayed})
+
+		session.Response.Header().Set("Content-Type", "application/json")
+		session.Response.WriteHeader(status)
+		session.Response.Write(content)
+	}
+}
+
+// The receipt handle of a fetched message: its ID and the receipt of its
+// lease, encoded so clients treat it as opaque.
+func ReceiptHandle(message *Message) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(message.Id + " " + message.Receipt))
+}
+
+// Sets a message's receipt from the receipt handle of the request. If the
+// handle is missing, unreadable or of another message, responds with 400 and
+// returns false.
+func ReadReceiptHandle(session *Session, message *Message) bool {
+	handle, err := base64.RawURLEncoding.DecodeString(session.Request.Header.Get("X-Receipt-Handle"))
+	fields := strings.Fields(string(handle))
+
+	if err != nil || len(fields) != 2 || fields[0] != message.Id {
+		session.Response.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+
+	message.Receipt = fields[1]
+
+	return true
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A front handler over the memory backend, routed as the daemon is.
+func setupHandler() *FrontHandler {
+	return NewFrontHandler(setupMemory())
+}
+
+func request(handler http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, httptest.NewRequest(method, target, strings.NewReader(body)))
+
+	return response
+}
+
+func leaseRequest(handler http.Handler, method string, target string, receipt string) *httptest.ResponseRecorder {
+	leaseRequest := httptest.NewRequest(method, target, nil)
+	leaseRequest.Header.Set("X-Receipt-Handle", receipt)
+	leaseRequest.Header.Set("X-Visibility-Timeout", "60")
+
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, leaseRequest)
+
+	return response
+}
+
+// A backend which fails part way through replaying a range.
+type failingReplay struct {
+	*MemoryStore
+}
+
+func (store failingReplay) ReplayMessages(ctx context.Context, queue *Queue, from time.Time, to time.Time) (int, error) {
+	return 3, errors.New("message could not be delivered")
+}
+
+func TestEndpoints(t *testing.T) {
+	handler := setupHandler()
+
+	if response := request(handler, "PUT", "/q", `{"fifo": "yes"}`); response.Code != http.StatusBadRequest {
+		t.Error("Created a queue with invalid attributes:", response.Code)
+	}
+
+	if response := request(handler, "PUT", "/q", strings.Repeat(" ", MaxQueueConfigSize+1)); response.Code != http.StatusRequestEntityTooLarge {
+		t.Error("Read queue attributes larger than allowed:", response.Code)
+	}
+
+	if response := request(handler, "PUT", "/q", `{"max_message_size": 4}`); response.Code != http.StatusCreated {
+		t.Error("Could not create queue:", response.Code)
+	}
+
+	if response := request(handler, "GET", "/q", ""); !strings.Contains(response.Body.String(), `"max_message_size":4`) {
+		t.Error("Queue attributes weren't returned:", response.Body.String())
+	}
+
+	if response := request(handler, "POST", "/q/messages", "abcde"); response.Code != http.StatusRequestEntityTooLarge {
+		t.Error("Created a message larger than the queue allows:", response.Code)
+	}
+
+	response := request(handler, "POST", "/q/messages", "abcd")
+	messageId := response.Header().Get("X-Message-Id")
+
+	if response.Code != http.StatusCreated || messageId == "" {
+		t.Fatal("Could not create message:", response.Code)
+	}
+
+	if response = request(handler, "GET", "/q/messages", ""); response.Body.String() != "abcd" {
+		t.Error("Could not fetch message:", response.Code)
+	}
+
+	receipt := response.Header().Get("X-Receipt-Handle")
+
+	if response = request(handler, "GET", "/q/messages", ""); response.Code != http.StatusNoContent {
+		t.Error("Fetched a leased message:", response.Code)
+	}
+
+	// A leased message can still be read by its ID, in part.
+	partial := httptest.NewRequest("GET", "/q/messages/"+messageId, nil)
+	partial.Header.Set("Range", "bytes=2-")
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, partial)
+
+	if response.Code != http.StatusPartialContent || response.Body.String() != "cd" {
+		t.Error("Could not read part of a message:", response.Code)
+	}
+
+	if response = request(handler, "DELETE", "/q/messages/"+messageId, ""); response.Code != http.StatusConflict {
+		t.Error("Deleted a leased message without its receipt:", response.Code)
+	}
+
+	if response = leaseRequest(handler, "DELETE", "/q/messages/"+messageId, "garbage"); response.Code != http.StatusBadRequest {
+		t.Error("Deleted a message with a malformed receipt:", response.Code)
+	}
+
+	if response = leaseRequest(handler, "PUT", "/q/messages/"+messageId+"/lease", receipt); response.Code != http.StatusOK {
+		t.Fatal("Could not extend lease:", response.Code)
+	}
+
+	extended := response.Header().Get("X-Receipt-Handle")
+
+	if extended == receipt {
+		t.Error("Extended a lease without a new receipt handle")
+	}
+
+	if response = leaseRequest(handler, "DELETE", "/q/messages/"+messageId, receipt); response.Code != http.StatusConflict {
+		t.Error("Deleted a message with a stale receipt:", response.Code)
+	}
+
+	if response = leaseRequest(handler, "DELETE", "/q/messages/"+messageId+"/lease", extended); response.Code != http.StatusOK {
+		t.Error("Could not release lease:", response.Code)
+	}
+
+	if response = request(handler, "GET", "/q/messages", ""); response.Code != http.StatusOK {
+		t.Error("Could not fetch a released message:", response.Code)
+	}
+
+	receipt = response.Header().Get("X-Receipt-Handle")
+
+	if response = leaseRequest(handler, "DELETE", "/q/messages/"+messageId, receipt); response.Code != http.StatusAccepted {
+		t.Error("Could not delete message:", response.Code)
+	}
+
+	if response = request(handler, "GET", "/q/messages/"+messageId, ""); response.Code != http.StatusNotFound {
+		t.Error("Found message after deleting it:", response.Code)
+	}
+
+	// Nothing is retained in memory once deleted.
+	if response = request(handler, "POST", "/q/messages/"+messageId+"/replay", ""); response.Code != http.StatusNotImplemented {
+		t.Error("Replayed a message from memory:", response.Code)
+	}
+
+	if response = request(handler, "POST", "/q/replay?from=yesterday", ""); response.Code != http.StatusBadRequest {
+		t.Error("Replayed messages from an unreadable time:", response.Code)
+	}
+
+	if response = request(handler, "POST", "/q/replay?from=2024-01-02T00:00:00Z&to=2024-01-01T00:00:00Z", ""); response.Code != http.StatusBadRequest {
+		t.Error("Replayed messages from an empty range:", response.Code)
+	}
+
+	if response = request(handler, "POST", "/q/replay?from=2024-01-01T00:00:00Z", ""); response.Code != http.StatusNotImplemented {
+		t.Error("Replayed messages from memory:", response.Code)
+	}
+}
+
+func TestReplayFailure(t *testing.T) {
+	handler := NewFrontHandler(failingReplay{setupMemory()})
+
+	response := request(handler, "POST", "/q/replay", "")
+
+	if response.Code != http.StatusInternalServerError || response.Body.String() != `{"replayed":3}` {
+		t.Error("Failed replay didn't report what was replayed:", response.Code, response.Body.String())
+	}
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"code.google.com/p/go.exp/inotify"
+	"container/list"
+	"github.com/softlayer/mq/spool"
+	"log"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An empty queue is scanned again at most this often when fetched from, in
+// case the events announcing its messages were missed.
+const IndexLifetime = 1 * time.Second
+
+// Events on a queue's folder, or on one of its buckets, which change what is
+// ready in it. Creation only matters for buckets, as message files are only
+// ready once they are moved in or done being written.
+const QueueEvents = inotify.IN_CREATE | inotify.IN_CLOSE_WRITE | inotify.IN_MOVED_TO | inotify.IN_MOVED_FROM | inotify.IN_DELETE
+
+// Events on the queues folder, which announce queues coming and going.
+const QueuesEvents = inotify.IN_CREATE | inotify.IN_MOVED_TO | inotify.IN_MOVED_FROM | inotify.IN_DELETE
+
+// The IDs of the messages ready in each queue, so fetching doesn't read the
+// queue's folder every time. It is kept up to date by the store's own renames
+// and by inotify events for everything else, such as deliveries by the mover.
+// Every queue is scanned again periodically, and whenever it looks empty, so
+// a missed event only delays a message.
+type ReadyIndex struct {
+	Store     *Store
+	Watcher   *inotify.Watcher
+	Reconcile time.Duration
+	Queues    map[string]*QueueIndex
+	Watched   map[string]bool
+	Overflows int
+	Lock      sync.Mutex
+}
+
+// Message IDs oldest first by the time in their ID, with the element of each.
+// Messages are mostly added newest, so keeping the order on insert rarely
+// walks far, and the oldest is always in front.
+type QueueIndex struct {
+	Ids     *list.List
+	Entries map[string]*list.Element
+	Scanned time.Time
+}
+
+func NewReadyIndex(store *Store, reconcile time.Duration) (*ReadyIndex, error) {
+	watcher, err := inotify.NewWatcher()
+
+	if err != nil {
+		return nil, err
+	}
+
+	index := &ReadyIndex{}
+	index.Store = store
+	index.Watcher = watcher
+	index.Reconcile = reconcile
+	index.Queues = make(map[string]*QueueIndex)
+	index.Watched = make(map[string]bool)
+
+	return index, nil
+}
+
+// Builds the index of every queue and keeps it up to date until the store is
+// closed.
+func (store *Store) PrepareIndex(reconcile time.Duration) {
+	index, err := NewReadyIndex(store, reconcile)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store.Index = index
+
+	if err = index.Watcher.AddWatch(store.QueuesFolder, QueuesEvents); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, queue := range index.ListQueues() {
+		index.Watch(queue)
+	}
+
+	store.Working.Add(1)
+
+	go index.Run()
+}
+
+func (index *ReadyIndex) ListQueues() []*Queue {
+	queuesDir, err := os.Open(index.Store.QueuesFolder)
+
+	if err != nil {
+		return nil
+	}
+
+	defer queuesDir.Close()
+
+	var queues []*Queue
+
+	for _, name := range ReadMessageIds(queuesDir, -1) {
+		if spool.QueueName.MatchString(name) {
+			queues = append(queues, &Queue{Id: name})
+		}
+	}
+
+	return queues
+}
+
+func (index *ReadyIndex) Run() {
+	defer index.Store.Working.Done()
+
+	ticker := time.NewTicker(index.Reconcile)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev := <-index.Watcher.Event:
+			index.Handle(ev)
+		case err := <-index.Watcher.Error:
+			log.Print(err)
+		case <-ticker.C:
+			index.ScanAll()
+		case <-index.Store.Quit:
+			index.Watcher.Close()
+			return
+		}
+	}
+}
+
+func (index *ReadyIndex) Handle(ev *inotify.Event) {
+	// Events were dropped, so anything could have happened.
+	if ev.Mask&inotify.IN_Q_OVERFLOW != 0 {
+		index.Lock.Lock()
+		index.Overflows += 1
+		index.Lock.Unlock()
+
+		log.Print("Rescanning every queue after an inotify overflow")
+		index.ScanAll()
+		return
+	}
+
+	if !strings.HasPrefix(ev.Name, index.Store.QueuesFolder+"/") {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(ev.Name, index.Store.QueuesFolder+"/"), "/")
+	queue := &Queue{Id: parts[0]}
+	name := parts[len(parts)-1]
+	arrived := ev.Mask&(inotify.IN_CREATE|inotify.IN_CLOSE_WRITE|inotify.IN_MOVED_TO) != 0
+
+	if !spool.QueueName.MatchString(queue.Id) || strings.HasPrefix(name, ".") {
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && ev.Mask&inotify.IN_ISDIR != 0 && arrived:
+		index.Watch(queue)
+	case len(parts) == 1 && ev.Mask&inotify.IN_ISDIR != 0:
+		index.Drop(queue)
+	case len(parts) == 2 && ev.Mask&inotify.IN_ISDIR != 0 && arrived:
+		index.WatchBucket(queue, ev.Name)
+	case ev.Mask&inotify.IN_ISDIR != 0:
+		return
+	case ev.Mask&(inotify.IN_CLOSE_WRITE|inotify.IN_MOVED_TO) != 0:
+		index.Add(queue, name)
+	case ev.Mask&(inotify.IN_MOVED_FROM|inotify.IN_DELETE) != 0:
+		index.Remove(queue, name)
+	}
+}
+
+func (index *ReadyIndex) AddWatch(folder string) {
+	index.Lock.Lock()
+	defer index.Lock.Unlock()
+
+	if index.Watched[folder] {
+		return
+	}
+
+	if err := index.Watcher.AddWatch(folder, QueueEvents); err != nil {
+		log.Print(err)
+		return
+	}
+
+	index.Watched[folder] = true
+}
+
+func (index *ReadyIndex) Unwatch(folder string) {
+	if index == nil {
+		return
+	}
+
+	index.Lock.Lock()
+	defer index.Lock.Unlock()
+
+	if index.Watched[folder] {
+		index.Watcher.RemoveWatch(folder)
+		delete(index.Watched, folder)
+	}
+}
+
+// Starts watching a queue and its buckets, then scans it. Watching comes
+// first, so nothing arriving in between is missed.
+func (index *ReadyIndex) Watch(queue *Queue) {
+	if index == nil {
+		return
+	}
+
+	queuePath := path.Join(index.Store.QueuesFolder, queue.Id)
+
+	if _, err := os.Stat(queuePath); err != nil {
+		return
+	}
+
+	index.AddWatch(queuePath)
+
+	if index.Store.Shard > 0 {
+		buckets, _ := index.Store.Buckets(queue)
+
+		for _, bucketPath := range buckets {
+			index.AddWatch(bucketPath)
+		}
+	}
+
+	index.Scan(queue)
+}
+
+// Starts watching a bucket which was just created, adding whatever already
+// made it in.
+func (index *ReadyIndex) WatchBucket(queue *Queue, bucketPath string) {
+	if index == nil {
+		return
+	}
+
+	index.AddWatch(bucketPath)
+
+	bucketDir, err := os.Open(bucketPath)
+
+	if err != nil {
+		return
+	}
+
+	defer bucketDir.Close()
+
+	for _, messageId := range ReadMessageIds(bucketDir, -1) {
+		index.Add(queue, messageId)
+	}
+}
+
+// Stops watching a queue and forgets everything about it.
+func (index *ReadyIndex) Drop(queue *Queue) {
+	if index == nil {
+		return
+	}
+
+	queuePath := path.Join(index.Store.QueuesFolder, queue.Id)
+
+	index.Lock.Lock()
+	defer index.Lock.Unlock()
+
+	for folder := range index.Watched {
+		if folder == queuePath || strings.HasPrefix(folder, queuePath+"/") {
+			index.Watcher.RemoveWatch(folder)
+			delete(index.Watched, folder)
+		}
+	}
+
+	delete(index.Queues, queue.Id)
+}
+
+// Reads a queue's folder, adding the messages the index missed and removing
+// the ones it should no longer have. Buckets left empty are removed.
+func (index *ReadyIndex) Scan(queue *Queue) {
+	index.Lock.Lock()
+	queueIndex := index.Queue(queue)
+	before := make(map[string]bool, len(queueIndex.Entries))
+
+	for messageId := range queueIndex.Entries {
+		before[messageId] = true
+	}
+
+	index.Lock.Unlock()
+
+	buckets, err := index.Store.Buckets(queue)
+
+	if err != nil {
+		index.Drop(queue)
+		return
+	}
+
+	found := make(map[string]bool)
+	var messageIds []string
+
+	for _, bucketPath := range buckets {
+		bucketDir, err := os.Open(bucketPath)
+
+		if err != nil {
+			continue
+		}
+
+		bucketIds := ReadMessageIds(bucketDir, -1)
+		bucketDir.Close()
+
+		if len(bucketIds) == 0 {
+			index.Store.RemoveBucket(bucketPath)
+		}
+
+		for _, messageId := range bucketIds {
+			found[messageId] = true
+			messageIds = append(messageIds, messageId)
+		}
+	}
+
+	index.Lock.Lock()
+	defer index.Lock.Unlock()
+
+	// Only what was there before we started reading can be missing from
+	// what we read. Anything newer arrived in the meantime.
+	for messageId := range before {
+		if !found[messageId] {
+			index.RemoveLocked(queueIndex, messageId)
+		}
+	}
+
+	for _, messageId := range messageIds {
+		index.AddLocked(queueIndex, messageId)
+	}
+
+	queueIndex.Scanned = time.Now()
+}
+
+func (index *ReadyIndex) ScanAll() {
+	index.Lock.Lock()
+	queues := make([]*Queue, 0, len(index.Queues))
+
+	for queueId := range index.Queues {
+		queues = append(queues, &Queue{Id: queueId})
+	}
+
+	index.Lock.Unlock()
+
+	for _, queue := range queues {
+		index.Scan(queue)
+	}
+}
+
+// Returns the index of a queue, creating an empty one if needed. The lock must
+// be held.
+func (index *ReadyIndex) Queue(queue *Queue) *QueueIndex {
+	queueIndex := index.Queues[queue.Id]
+
+	if queueIndex == nil {
+		queueIndex = &QueueIndex{
+			Ids:     list.New(),
+			Entries: make(map[string]*list.Element),
+		}
+
+		index.Queues[queue.Id] = queueIndex
+	}
+
+	return queueIndex
+}
+
+func (index *ReadyIndex) AddLocked(queueIndex *QueueIndex, messageId string) {
+	if queueIndex.Entries[messageId] != nil || !spool.MessageName.MatchString(messageId) {
+		return
+	}
+
+	created := spool.UUIDTime(messageId)
+	element := queueIndex.Ids.Back()
+
+	for element != nil && created.Before(spool.UUIDTime(element.Value.(string))) {
+		element = element.Prev()
+	}
+
+	if element == nil {
+		queueIndex.Entries[messageId] = queueIndex.Ids.PushFront(messageId)
+	} else {
+		queueIndex.Entries[messageId] = queueIndex.Ids.InsertAfter(messageId, element)
+	}
+}
+
+func (index *ReadyIndex) RemoveLocked(queueIndex *QueueIndex, messageId string) {
+	if element := queueIndex.Entries[messageId]; element != nil {
+		queueIndex.Ids.Remove(element)
+		delete(queueIndex.Entries, messageId)
+	}
+}
+
+func (index *ReadyIndex) Add(queue *Queue, messageId string) {
+	if index == nil {
+		return
+	}
+
+	index.Lock.Lock()
+	defer index.Lock.Unlock()
+
+	if queueIndex := index.Queues[queue.Id]; queueIndex != nil {
+		index.AddLocked(queueIndex, messageId)
+	}
+}
+
+func (index *ReadyIndex) Remove(queue *Queue, messageId string) {
+	if index == nil {
+		return
+	}
+
+	index.Lock.Lock()
+	defer index.Lock.Unlock()
+
+	if queueIndex := index.Queues[queue.Id]; queueIndex != nil {
+		index.RemoveLocked(queueIndex, messageId)
+	}
+}
+
+// Chooses the next message to fetch, as PickReady does. A queue which looks
+// empty, or was never seen, is watched or scanned first.
+func (index *ReadyIndex) Pick(queue *Queue, config *QueueConfig) string {
+	index.Lock.Lock()
+	queueIndex := index.Queues[queue.Id]
+	stale := queueIndex == nil || queueIndex.Ids.Len() == 0 && time.Since(queueIndex.Scanned) > IndexLifetime
+	index.Lock.Unlock()
+
+	if queueIndex == nil {
+		index.Watch(queue)
+	} else if stale {
+		index.Scan(queue)
+	}
+
+	index.Lock.Lock()
+	defer index.Lock.Unlock()
+
+	queueIndex = index.Queues[queue.Id]
+
+	if queueIndex == nil || queueIndex.Ids.Len() == 0 {
+		return ""
+	}
+
+	element := queueIndex.Ids.Front()
+
+	for i := PickReady(index.Store.Peers, queueIndex.Ids.Len(), config.Fifo); i > 0; i-- {
+		element = element.Next()
+	}
+
+	return element.Value.(string)
+}
+
+// Which of the messages ready in a queue, oldest first, is fetched next: the
+// oldest for strict ordering, otherwise any of the oldest peers+1, so peers
+// fetching at once rarely go for the same one. Every backend chooses this way.
+func PickReady(peers int, ready int, fifo bool) int {
+	if fifo {
+		return 0
+	}
+
+	return rand.Intn(min(peers+1, ready))
+}
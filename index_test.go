@@ -0,0 +1,131 @@
+package main
+
+import (
+	"code.google.com/p/go.exp/inotify"
+	"context"
+	"github.com/softlayer/mq/spool"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// Whether a message is indexed, read under the lock the index is kept with.
+func isIndexed(store *Store, queue *Queue, messageId string) bool {
+	store.Index.Lock.Lock()
+	defer store.Index.Lock.Unlock()
+
+	queueIndex := store.Index.Queues[queue.Id]
+
+	return queueIndex != nil && queueIndex.Entries[messageId] != nil
+}
+
+// Waits for the index to catch up with an event, for up to a second.
+func waitIndexed(store *Store, queue *Queue, messageId string) bool {
+	for i := 0; i < 100; i++ {
+		if isIndexed(store, queue, messageId) {
+			return true
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return false
+}
+
+func TestReadyIndex(t *testing.T) {
+	ctx := context.Background()
+
+	store := setup(t)
+
+	queue := &Queue{Id: queueId}
+	store.SaveQueue(ctx, queue)
+
+	// A message already waiting is found by the first scan.
+	ioutil.WriteFile(path.Join(store.QueuesFolder, queueId, "a"), messageContent, 0666)
+	store.PrepareIndex(time.Minute)
+
+	if !waitIndexed(store, queue, "a") {
+		t.Error("Message waiting at startup wasn't indexed")
+	}
+
+	// A message delivered by the mover is found through its event.
+	newPath := path.Join(store.NewFolder, queueId+":b")
+	ioutil.WriteFile(newPath, messageContent, 0666)
+	os.Rename(newPath, path.Join(store.QueuesFolder, queueId, "b"))
+
+	if !waitIndexed(store, queue, "b") {
+		t.Error("Message delivered after startup wasn't indexed")
+	}
+
+	var fetched *Message
+
+	for range 2 {
+		message, _ := store.FetchMessage(ctx, queue)
+
+		if message == nil {
+			t.Fatal("Could not fetch indexed message")
+		}
+
+		message.Body.Close()
+		fetched = message
+
+		if isIndexed(store, queue, message.Id) {
+			t.Error("Fetched message is still indexed")
+		}
+	}
+
+	// Our own renames are indexed right away.
+	if store.ReleaseMessage(ctx, queue, fetched) != nil || !isIndexed(store, queue, fetched.Id) {
+		t.Error("Released message wasn't indexed")
+	}
+
+	// After an overflow, the index is rebuilt from the folder.
+	os.Remove(path.Join(store.QueuesFolder, queueId, fetched.Id))
+	store.Index.Handle(&inotify.Event{Mask: inotify.IN_Q_OVERFLOW})
+
+	store.Index.Lock.Lock()
+	overflows, ready := store.Index.Overflows, store.Index.Queues[queueId].Ids.Len()
+	store.Index.Lock.Unlock()
+
+	if overflows != 1 || ready != 0 {
+		t.Error("Index wasn't rebuilt after an overflow")
+	}
+
+	if !store.Close(context.Background()) {
+		t.Error("Could not stop the index")
+	}
+}
+
+func TestReadyIndexOrder(t *testing.T) {
+	store := setup(t)
+	store.SaveQueue(context.Background(), &Queue{Id: queueId})
+	store.PrepareIndex(time.Minute)
+
+	queue := &Queue{Id: queueId}
+	older := spool.TimeUUID()
+	newer := spool.TimeUUID()
+
+	// Indexed out of order, as a released message is.
+	store.Index.Add(queue, newer)
+	store.Index.Add(queue, older)
+	store.Index.Add(queue, "plain")
+
+	store.Index.Lock.Lock()
+	front := store.Index.Queues[queueId].Ids.Front()
+	order := []string{front.Value.(string), front.Next().Value.(string), front.Next().Next().Value.(string)}
+	store.Index.Lock.Unlock()
+
+	if order[0] != "plain" || order[1] != older || order[2] != newer {
+		t.Error("Index isn't kept oldest first", order)
+	}
+
+	store.Index.Remove(queue, "plain")
+
+	if picked := store.Index.Pick(queue, &QueueConfig{Fifo: true}); picked != older {
+		t.Error("Oldest message wasn't picked", picked)
+	}
+
+	store.Close(context.Background())
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMessageTooLarge = errors.New("message is larger than the queue allows")
+	ErrQueueFull       = errors.New("queue holds as many messages as it allows")
+	ErrQueueTooLarge   = errors.New("queue holds as many bytes as it allows")
+)
+
+// How long a queue's usage is trusted before its folders are read again. In
+// between, messages saved by this daemon are added to the last reading.
+const UsageLifetime = time.Second
+
+// Messages and Bytes are what was found on disk, plus what this daemon saved
+// since. Pending is what was admitted but isn't on disk yet, which no reading
+// can see, so it is kept across them.
+type QueueUsage struct {
+	Messages     int64
+	Bytes        int64
+	Pending      int64
+	PendingBytes int64
+	Read         time.Time
+}
+
+// Server-wide limits, overridden by smaller limits of each queue. Zero means
+// unlimited.
+type Limits struct {
+	MaxMessageSize   int64
+	MaxQueueMessages int64
+	MaxQueueBytes    int64
+}
+
+// The smaller of a server-wide and a per-queue limit, where zero means
+// unlimited.
+func Limit(server int64, queue int64) int64 {
+	if server == 0 || (queue > 0 && queue < server) {
+		return queue
+	}
+
+	return server
+}
+
+func (limits *Limits) MessageSizeLimit(config *QueueConfig) int64 {
+	return Limit(limits.MaxMessageSize, config.MaxMessageSize)
+}
+
+// Whether a queue's usage matters, which is only when its capacity is limited.
+func (limits *Limits) Capped(config *QueueConfig) bool {
+	return Limit(limits.MaxQueueMessages, config.MaxMessages) > 0 || Limit(limits.MaxQueueBytes, config.MaxBytes) > 0
+}
+
+// Decides whether a message of the given size fits in a queue with the given
+// usage. The usage may be nil if the queue's capacity isn't capped.
+func (limits *Limits) Check(config *QueueConfig, usage *QueueUsage, size int64) error {
+	sizeLimit := limits.MessageSizeLimit(config)
+
+	if sizeLimit > 0 && size > sizeLimit {
+		return ErrMessageTooLarge
+	}
+
+	if usage == nil {
+		return nil
+	}
+
+	messagesLimit := Limit(limits.MaxQueueMessages, config.MaxMessages)
+	bytesLimit := Limit(limits.MaxQueueBytes, config.MaxBytes)
+
+	if messagesLimit > 0 && usage.Messages+usage.Pending+1 > messagesLimit {
+		return ErrQueueFull
+	}
+
+	if bytesLimit > 0 && usage.Bytes+usage.PendingBytes+size > bytesLimit {
+		return ErrQueueTooLarge
+	}
+
+	return nil
+}
+
+// Decides whether a message of the given size fits in a queue, and sets it
+// aside as pending if it does. This happens before anything is written, so a
+// full queue or disk costs nothing but the check.
+func (store *Store) Admit(queue *Queue, config *QueueConfig, size int64) error {
+	if !store.Capped(config) {
+		return store.Check(config, nil, size)
+	}
+
+	store.UsageLock.Lock()
+	usage := store.Usage[queue.Id]
+
+	// The folders are read without holding the lock, so saves to other
+	// queues aren't held up behind a large directory.
+	if usage == nil || time.Since(usage.Read) > UsageLifetime {
+		store.UsageLock.Unlock()
+		reading := store.ReadUsage(queue)
+		store.UsageLock.Lock()
+
+		if usage = store.Usage[queue.Id]; usage == nil {
+			usage = &QueueUsage{}
+			store.Usage[queue.Id] = usage
+		}
+
+		if reading.Read.After(usage.Read) {
+			usage.Messages = reading.Messages
+			usage.Bytes = reading.Bytes
+			usage.Read = reading.Read
+		}
+	}
+
+	defer store.UsageLock.Unlock()
+
+	err := store.Check(config, usage, size)
+
+	if err == nil {
+		usage.Pending += 1
+		usage.PendingBytes += size
+	}
+
+	return err
+}
+
+// Settles what Admit set aside for a message of the given size once its save
+// is over. A saved message counts against the queue with the size it turned
+// out to have, until its usage is read again; a failed save is given back.
+func (store *Store) Account(queue *Queue, config *QueueConfig, size int64, saved bool, savedSize int64) {
+	if !store.Capped(config) {
+		return
+	}
+
+	store.UsageLock.Lock()
+	defer store.UsageLock.Unlock()
+
+	usage := store.Usage[queue.Id]
+
+	if usage == nil {
+		return
+	}
+
+	usage.Pending -= 1
+	usage.PendingBytes -= size
+
+	if saved {
+		usage.Messages += 1
+		usage.Bytes += savedSize
+	}
+}
+
+// Counts the messages waiting for a queue, and their bytes: those still in
+// the new folder as well as those in the queue's folders. The new folder is
+// read first, so a message moved in between is counted twice rather than
+// missed.
+func (store *Store) ReadUsage(queue *Queue) *QueueUsage {
+	usage := &QueueUsage{Read: time.Now()}
+	buckets, _ := store.Buckets(queue)
+
+	usage.Count(store.NewFolder, queue.Id+":")
+
+	for _, bucketPath := range buckets {
+		usage.Count(bucketPath, "")
+	}
+
+	return usage
+}
+
+// Adds the files of a folder which start with the given prefix, skipping
+// those still being written.
+func (usage *QueueUsage) Count(folder string, prefix string) {
+	dir, err := os.Open(folder)
+
+	if err != nil {
+		return
+	}
+
+	defer dir.Close()
+
+	for {
+		infos, err := dir.Readdir(1024)
+
+		for _, info := range infos {
+			if !strings.HasPrefix(info.Name(), ".") && strings.HasPrefix(info.Name(), prefix) {
+				usage.Messages += 1
+				usage.Bytes += info.Size()
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+}
+
+// Reads the whole content of a message being saved, for the backends which
+// hold it in memory or write it in one go. What is known to be too large isn't
+// read at all, and reading stops once it proves too large. Nothing is kept for
+// a client which is gone, even once it was read.
+func (limits *Limits) ReadContent(ctx context.Context, config *QueueConfig, message *Message) ([]byte, error) {
+	if message.Size > 0 && limits.Check(config, nil, message.Size) != nil {
+		return nil, ErrMessageTooLarge
+	}
+
+	var body io.Reader = &ContextReader{Context: ctx, Reader: message.Body}
+
+	if limit := limits.MessageSizeLimit(config); limit > 0 {
+		body = &SizeLimiter{Reader: body, Remaining: limit}
+	}
+
+	content, err := ioutil.ReadAll(body)
+
+	if err == ErrMessageTooLarge {
+		return nil, err
+	}
+
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+
+	if err != nil {
+		return nil, ErrNotSaved
+	}
+
+	return content, nil
+}
+
+// Reads from the underlying reader until more than Remaining bytes were read,
+// at which point every read fails with ErrMessageTooLarge. Used when a
+// message's size isn't known up front.
+type SizeLimiter struct {
+	Reader    io.Reader
+	Remaining int64
+}
+
+func (limiter *SizeLimiter) Read(p []byte) (int, error) {
+	if int64(len(p)) > limiter.Remaining+1 {
+		p = p[:limiter.Remaining+1]
+	}
+
+	n, err := limiter.Reader.Read(p)
+	limiter.Remaining -= int64(n)
+
+	if limiter.Remaining < 0 {
+		return n, ErrMessageTooLarge
+	}
+
+	return n, err
+}
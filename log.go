@@ -0,0 +1,1047 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"container/list"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/softlayer/mq/spool"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The prefix of a root selecting the log backend for the whole server, as in
+// log:///var/mq.
+const LogScheme = "log://"
+
+// Segments are closed, and a new one started, once they grow past this size.
+const SegmentSize = 64 << 20
+
+// The size of a record's header: a CRC-32 of the ID and content, the length of
+// the ID and the length of the content.
+const RecordHeaderSize = 4 + 2 + 8
+
+// Indexes are rewritten once they hold this many more lines than needed.
+const IndexSlack = 1024
+
+// A backend appending messages to segment files, for queues of many small
+// messages where a file per message costs too much. Each queue is a folder
+// holding its attributes, its segments and an index journal of leases and
+// acknowledgements. A segment is unlinked as soon as all of its messages are
+// deleted. Everything is held under a single lock, and the state of each queue
+// is rebuilt from its folder the first time it is used.
+//
+// Ready messages are kept oldest first by the time in their ID, like the
+// ready index of the file system, and leased ones by when their lease runs
+// out, so fetching, leasing and acknowledging don't depend on the size of the
+// queue.
+type LogStore struct {
+	Limits
+	Unretained
+
+	Peers      int
+	Visibility time.Duration
+	Root       string
+	Queues     map[string]*LogQueue
+	Lock       sync.Mutex
+
+	// The store this one keeps the log queues of, if any. Dead letters
+	// whose queue isn't in the log are handed to it.
+	Owner Backend
+}
+
+type LogQueue struct {
+	Path       string
+	Config     *QueueConfig
+	Segments   map[int64]*LogSegment
+	Active     *LogSegment
+	Index      *os.File
+	IndexLines int
+	Entries    map[string]*LogEntry
+	Ready      *list.List
+	Leased     map[string]*LogEntry
+	Leases     Leases
+	Bytes      int64
+}
+
+type LogSegment struct {
+	Number int64
+	Path   string
+	File   *os.File
+	Size   int64
+	Live   int
+	Acked  []string
+}
+
+// Where a message's content lives, and the state of its lease. Created is
+// the time in its ID, read once. While ready, Element is its place among the
+// ready messages, and while leased, Lease is its place among the leases.
+type LogEntry struct {
+	Id       string
+	Segment  *LogSegment
+	Offset   int64
+	Size     int64
+	Created  time.Time
+	Deadline time.Time
+	Receives int
+	Element  *list.Element
+	Lease    int
+}
+
+// The leased messages of a queue, as a heap with the one whose lease runs out
+// first on top.
+type Leases []*LogEntry
+
+func (leases Leases) Len() int {
+	return len(leases)
+}
+
+func (leases Leases) Less(i, j int) bool {
+	return leases[i].Deadline.Before(leases[j].Deadline)
+}
+
+func (leases Leases) Swap(i, j int) {
+	leases[i], leases[j] = leases[j], leases[i]
+	leases[i].Lease = i
+	leases[j].Lease = j
+}
+
+func (leases *Leases) Push(entry interface{}) {
+	entry.(*LogEntry).Lease = len(*leases)
+	*leases = append(*leases, entry.(*LogEntry))
+}
+
+func (leases *Leases) Pop() interface{} {
+	last := len(*leases) - 1
+	entry := (*leases)[last]
+	*leases = (*leases)[:last]
+
+	return entry
+}
+
+// The content of a message in a segment. Each one opens the segment anew, so
+// it can still be read if the segment is unlinked in the meantime.
+type LogBody struct {
+	*io.SectionReader
+	File *os.File
+}
+
+func (body LogBody) Close() error {
+	return body.File.Close()
+}
+
+func NewLogStore(peers int, root string) *LogStore {
+	store := &LogStore{}
+	store.Peers = peers
+	store.Root = root
+	store.Queues = make(map[string]*LogQueue)
+
+	os.MkdirAll(root, 0777)
+
+	return store
+}
+
+// Returns the state of a queue, loading it on first use. With create, a queue
+// which doesn't exist yet is created.
+func (store *LogStore) Queue(queue *Queue, create bool) (*LogQueue, error) {
+	logQueue := store.Queues[queue.Id]
+
+	if logQueue != nil {
+		return logQueue, nil
+	}
+
+	queuePath := path.Join(store.Root, queue.Id)
+
+	if _, err := os.Stat(queuePath); err != nil {
+		if !create {
+			return nil, ErrQueueNotFound
+		}
+
+		if err = os.Mkdir(queuePath, 0777); err != nil {
+			return nil, err
+		}
+	}
+
+	logQueue, err := LoadLogQueue(queuePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	store.Queues[queue.Id] = logQueue
+
+	return logQueue, nil
+}
+
+// Rebuilds a queue from its folder: every intact record of every segment, then
+// the leases and acknowledgements of the index. A record torn by a crash ends
+// its segment, and is cut off.
+func LoadLogQueue(queuePath string) (*LogQueue, error) {
+	logQueue := &LogQueue{
+		Path:     queuePath,
+		Config:   &QueueConfig{},
+		Segments: make(map[int64]*LogSegment),
+		Entries:  make(map[string]*LogEntry),
+		Ready:    list.New(),
+		Leased:   make(map[string]*LogEntry),
+	}
+
+	content, err := ioutil.ReadFile(path.Join(queuePath, ConfigFile))
+
+	if err == nil && json.Unmarshal(content, logQueue.Config) != nil {
+		log.Print("Ignoring unreadable attributes of ", queuePath)
+	}
+
+	names, err := ioutil.ReadDir(queuePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var numbers []int64
+
+	for _, info := range names {
+		if number, err := strconv.ParseInt(strings.TrimSuffix(info.Name(), ".log"), 10, 64); err == nil && strings.HasSuffix(info.Name(), ".log") {
+			numbers = append(numbers, number)
+		}
+	}
+
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	for _, number := range numbers {
+		segment, err := logQueue.LoadSegment(number)
+
+		if err != nil {
+			return nil, err
+		}
+
+		logQueue.Segments[number] = segment
+		logQueue.Active = segment
+	}
+
+	err = logQueue.LoadIndex()
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	for _, number := range numbers {
+		segment := logQueue.Segments[number]
+
+		// Segments whose messages were all deleted before we stopped.
+		if segment.Live == 0 && segment != logQueue.Active {
+			logQueue.RemoveSegment(segment)
+		}
+	}
+
+	var ready []*LogEntry
+
+	for _, entry := range logQueue.Entries {
+		if now.Before(entry.Deadline) {
+			logQueue.Leased[entry.Id] = entry
+			heap.Push(&logQueue.Leases, entry)
+		} else {
+			ready = append(ready, entry)
+		}
+	}
+
+	// Messages created at the same time keep the order they were appended
+	// in.
+	sort.Slice(ready, func(i, j int) bool {
+		a, b := ready[i], ready[j]
+
+		if !a.Created.Equal(b.Created) {
+			return a.Created.Before(b.Created)
+		}
+
+		return a.Segment.Number < b.Segment.Number || a.Segment == b.Segment && a.Offset < b.Offset
+	})
+
+	for _, entry := range ready {
+		entry.Element = logQueue.Ready.PushBack(entry)
+		logQueue.Bytes += entry.Size
+	}
+
+	return logQueue, nil
+}
+
+func (logQueue *LogQueue) SegmentPath(number int64) string {
+	return path.Join(logQueue.Path, fmt.Sprintf("%016d.log", number))
+}
+
+func (logQueue *LogQueue) LoadSegment(number int64) (*LogSegment, error) {
+	segment := &LogSegment{Number: number, Path: logQueue.SegmentPath(number)}
+	file, err := os.OpenFile(segment.Path, os.O_RDWR, 0666)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	segment.File = file
+	reader := bufio.NewReader(file)
+	header := make([]byte, RecordHeaderSize)
+
+	for {
+		_, err := io.ReadFull(reader, header)
+
+		if err == io.EOF {
+			break
+		}
+
+		idSize := int64(binary.BigEndian.Uint16(header[4:6]))
+		contentSize := int64(binary.BigEndian.Uint64(header[6:14]))
+		var record []byte
+
+		// A torn header may claim any size, so it is only trusted as far
+		// as the segment goes. The sizes are compared by what is left of
+		// the segment, as a huge one would overflow a sum.
+		if err == nil && contentSize >= 0 && contentSize <= info.Size()-segment.Size-RecordHeaderSize-idSize {
+			record = make([]byte, idSize+contentSize)
+			_, err = io.ReadFull(reader, record)
+		} else if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+
+		if err != nil || crc32.ChecksumIEEE(record) != binary.BigEndian.Uint32(header[0:4]) {
+			log.Print("Cutting off torn record at ", segment.Path, ":", segment.Size)
+			file.Truncate(segment.Size)
+			break
+		}
+
+		entry := &LogEntry{
+			Id:      string(record[:idSize]),
+			Segment: segment,
+			Offset:  segment.Size + RecordHeaderSize + idSize,
+			Size:    contentSize,
+		}
+
+		entry.Created = spool.UUIDTime(entry.Id)
+
+		logQueue.Entries[entry.Id] = entry
+		segment.Live += 1
+		segment.Size += RecordHeaderSize + idSize + contentSize
+	}
+
+	_, err = file.Seek(segment.Size, io.SeekStart)
+
+	return segment, err
+}
+
+// Replays the index journal. Each line is either a lease, "L id deadline
+// receives" with a deadline in Unix nanoseconds (zero once released), or an
+// acknowledgement, "A id". Lines about messages no longer in any segment are
+// ignored.
+func (logQueue *LogQueue) LoadIndex() error {
+	indexPath := path.Join(logQueue.Path, "index")
+	content, err := ioutil.ReadFile(indexPath)
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+
+		if len(fields) < 2 {
+			continue
+		}
+
+		logQueue.IndexLines += 1
+		entry := logQueue.Entries[fields[1]]
+
+		if entry == nil {
+			continue
+		}
+
+		switch {
+		case fields[0] == "A":
+			delete(logQueue.Entries, entry.Id)
+			entry.Segment.Live -= 1
+			entry.Segment.Acked = append(entry.Segment.Acked, entry.Id)
+		case fields[0] == "L" && len(fields) == 4:
+			deadline, _ := strconv.ParseInt(fields[2], 10, 64)
+			entry.Receives, _ = strconv.Atoi(fields[3])
+			entry.Deadline = time.Time{}
+
+			if deadline > 0 {
+				entry.Deadline = time.Unix(0, deadline)
+			}
+		}
+	}
+
+	logQueue.Index, err = os.OpenFile(indexPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+
+	return err
+}
+
+func (logQueue *LogQueue) RemoveSegment(segment *LogSegment) {
+	segment.File.Close()
+	os.Remove(segment.Path)
+	delete(logQueue.Segments, segment.Number)
+}
+
+// Appends a message to the active segment, starting a new one when it is full.
+func (logQueue *LogQueue) Append(id string, content []byte) error {
+	if logQueue.Active == nil || logQueue.Active.Size >= SegmentSize {
+		number := int64(0)
+
+		if logQueue.Active != nil {
+			number = logQueue.Active.Number + 1
+
+			// The segment we are leaving may have been emptied while it
+			// was still active.
+			if logQueue.Active.Live == 0 {
+				logQueue.RemoveSegment(logQueue.Active)
+			}
+		}
+
+		segment := &LogSegment{Number: number, Path: logQueue.SegmentPath(number)}
+		file, err := os.OpenFile(segment.Path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+
+		if err != nil {
+			return err
+		}
+
+		segment.File = file
+		logQueue.Segments[number] = segment
+		logQueue.Active = segment
+	}
+
+	segment := logQueue.Active
+	record := make([]byte, RecordHeaderSize+len(id)+len(content))
+	binary.BigEndian.PutUint16(record[4:6], uint16(len(id)))
+	binary.BigEndian.PutUint64(record[6:14], uint64(len(content)))
+	copy(record[RecordHeaderSize:], id)
+	copy(record[RecordHeaderSize+len(id):], content)
+	binary.BigEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[RecordHeaderSize:]))
+
+	_, err := segment.File.Write(record)
+
+	if err == nil {
+		err = segment.File.Sync()
+	}
+
+	// Whatever part of the record made it is cut off again.
+	if err != nil {
+		segment.File.Truncate(segment.Size)
+		segment.File.Seek(segment.Size, io.SeekStart)
+		return ErrNotSaved
+	}
+
+	entry := &LogEntry{
+		Id:      id,
+		Segment: segment,
+		Offset:  segment.Size + RecordHeaderSize + int64(len(id)),
+		Size:    int64(len(content)),
+		Created: spool.UUIDTime(id),
+	}
+
+	segment.Size += int64(len(record))
+	segment.Live += 1
+
+	logQueue.Entries[id] = entry
+	logQueue.MakeReady(entry)
+
+	return nil
+}
+
+func (logQueue *LogQueue) Journal(line string) error {
+	_, err := logQueue.Index.WriteString(line + "\n")
+
+	if err == nil {
+		err = logQueue.Index.Sync()
+	}
+
+	logQueue.IndexLines += 1
+
+	return err
+}
+
+func LeaseLine(id string, deadline time.Time, receives int) string {
+	nanos := int64(0)
+
+	if !deadline.IsZero() {
+		nanos = deadline.UnixNano()
+	}
+
+	return fmt.Sprintf("L %s %d %d", id, nanos, receives)
+}
+
+// Leases a message until the given deadline, or makes it ready again with a
+// zero one.
+func (logQueue *LogQueue) Lease(entry *LogEntry, deadline time.Time) error {
+	err := logQueue.Journal(LeaseLine(entry.Id, deadline, entry.Receives))
+
+	if err != nil {
+		return err
+	}
+
+	entry.Deadline = deadline
+
+	switch {
+	case deadline.IsZero():
+		logQueue.Unlease(entry)
+		logQueue.MakeReady(entry)
+	case logQueue.Leased[entry.Id] != nil:
+		heap.Fix(&logQueue.Leases, entry.Lease)
+	default:
+		logQueue.Unready(entry)
+		logQueue.Leased[entry.Id] = entry
+		heap.Push(&logQueue.Leases, entry)
+	}
+
+	return nil
+}
+
+// Makes the messages whose lease ran out ready again. Nothing needs to be
+// written, as an expired lease is read back as ready anyway.
+func (logQueue *LogQueue) Expire(now time.Time) {
+	for logQueue.Leases.Len() > 0 && now.After(logQueue.Leases[0].Deadline) {
+		entry := logQueue.Leases[0]
+		logQueue.Unlease(entry)
+		logQueue.MakeReady(entry)
+	}
+}
+
+// Acknowledges a message, wherever it is, unlinking its segment if it was the
+// last one alive in it.
+func (logQueue *LogQueue) Ack(entry *LogEntry) error {
+	err := logQueue.Journal("A " + entry.Id)
+
+	if err != nil {
+		return err
+	}
+
+	delete(logQueue.Entries, entry.Id)
+	logQueue.Unlease(entry)
+	logQueue.Unready(entry)
+
+	segment := entry.Segment
+	segment.Live -= 1
+	segment.Acked = append(segment.Acked, entry.Id)
+
+	if segment.Live == 0 && segment != logQueue.Active {
+		logQueue.RemoveSegment(segment)
+	}
+
+	logQueue.Compact()
+
+	return nil
+}
+
+// Adds a message to the ready ones, walking to its place from whichever end
+// is nearer by time. New messages mostly go at the back, and the ones whose
+// leases ran out near the front, so it rarely walks far.
+func (logQueue *LogQueue) MakeReady(entry *LogEntry) {
+	ready := logQueue.Ready
+	front, back := ready.Front(), ready.Back()
+
+	switch {
+	case back == nil || !entry.Created.Before(back.Value.(*LogEntry).Created):
+		entry.Element = ready.PushBack(entry)
+	case entry.Created.Sub(front.Value.(*LogEntry).Created) < back.Value.(*LogEntry).Created.Sub(entry.Created):
+		element := front
+
+		for !entry.Created.Before(element.Value.(*LogEntry).Created) {
+			element = element.Next()
+		}
+
+		entry.Element = ready.InsertBefore(entry, element)
+	default:
+		element := back
+
+		for element != nil && entry.Created.Before(element.Value.(*LogEntry).Created) {
+			element = element.Prev()
+		}
+
+		if element == nil {
+			entry.Element = ready.PushFront(entry)
+		} else {
+			entry.Element = ready.InsertAfter(entry, element)
+		}
+	}
+
+	logQueue.Bytes += entry.Size
+}
+
+func (logQueue *LogQueue) Unready(entry *LogEntry) {
+	if entry.Element != nil {
+		logQueue.Ready.Remove(entry.Element)
+		logQueue.Bytes -= entry.Size
+		entry.Element = nil
+	}
+}
+
+func (logQueue *LogQueue) Unlease(entry *LogEntry) {
+	if logQueue.Leased[entry.Id] != nil {
+		heap.Remove(&logQueue.Leases, entry.Lease)
+		delete(logQueue.Leased, entry.Id)
+	}
+}
+
+// Rewrites the index once it is mostly about segments which are gone, keeping
+// only the acknowledgements of live segments and the leases of live messages.
+func (logQueue *LogQueue) Compact() {
+	needed := len(logQueue.Entries)
+
+	for _, segment := range logQueue.Segments {
+		needed += len(segment.Acked)
+	}
+
+	if logQueue.IndexLines < 2*needed+IndexSlack {
+		return
+	}
+
+	var lines []string
+
+	for _, segment := range logQueue.Segments {
+		for _, id := range segment.Acked {
+			lines = append(lines, "A "+id)
+		}
+	}
+
+	for _, entry := range logQueue.Entries {
+		if entry.Receives > 0 {
+			lines = append(lines, LeaseLine(entry.Id, entry.Deadline, entry.Receives))
+		}
+	}
+
+	indexPath := path.Join(logQueue.Path, "index")
+	content := strings.Join(lines, "\n") + "\n"
+
+	// The index is only replaced once the new one is flushed, so a crash
+	// leaves either of them whole.
+	err := WriteSynced(indexPath+".tmp", []byte(content))
+
+	if err == nil {
+		err = os.Rename(indexPath+".tmp", indexPath)
+	}
+
+	if err != nil {
+		log.Print("Could not compact ", indexPath, ": ", err)
+		return
+	}
+
+	logQueue.Index.Close()
+	logQueue.Index, err = os.OpenFile(indexPath, os.O_WRONLY|os.O_APPEND, 0666)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logQueue.IndexLines = len(lines)
+}
+
+// Writes a file and flushes it to stable media before returning.
+func WriteSynced(file string, content []byte) error {
+	writer, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(content)
+
+	if err == nil {
+		err = writer.Sync()
+	}
+
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+func (logQueue *LogQueue) Open(entry *LogEntry) (*Message, error) {
+	file, err := os.Open(entry.Segment.Path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		Id:   entry.Id,
+		Size: entry.Size,
+		Body: LogBody{io.NewSectionReader(file, entry.Offset, entry.Size), file},
+	}, nil
+}
+
+func (logQueue *LogQueue) Read(entry *LogEntry) ([]byte, error) {
+	content := make([]byte, entry.Size)
+	_, err := entry.Segment.File.ReadAt(content, entry.Offset)
+
+	return content, err
+}
+
+func (store *LogStore) SaveQueue(ctx context.Context, queue *Queue) error {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	logQueue, err := store.Queue(queue, true)
+
+	// Without attributes, whatever the queue had before is kept.
+	if err != nil || queue.Config == nil {
+		return err
+	}
+
+	content, err := json.Marshal(queue.Config)
+
+	if err != nil {
+		return err
+	}
+
+	configPath := path.Join(logQueue.Path, ConfigFile)
+	err = ioutil.WriteFile(configPath+".tmp", content, 0666)
+
+	if err == nil {
+		err = os.Rename(configPath+".tmp", configPath)
+	}
+
+	if err == nil {
+		config := *queue.Config
+		logQueue.Config = &config
+	}
+
+	return err
+}
+
+func (store *LogStore) FetchQueue(ctx context.Context, queue *Queue) error {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	logQueue, err := store.Queue(queue, false)
+
+	if err != nil {
+		return err
+	}
+
+	config := *logQueue.Config
+	queue.Config = &config
+
+	return nil
+}
+
+func (store *LogStore) DeleteQueue(ctx context.Context, queue *Queue) error {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	if logQueue := store.Queues[queue.Id]; logQueue != nil {
+		for _, segment := range logQueue.Segments {
+			segment.File.Close()
+		}
+
+		logQueue.Index.Close()
+		delete(store.Queues, queue.Id)
+	}
+
+	return os.RemoveAll(path.Join(store.Root, queue.Id))
+}
+
+func (store *LogStore) SaveMessage(ctx context.Context, queue *Queue, message *Message) error {
+	store.Lock.Lock()
+	logQueue, err := store.Queue(queue, false)
+
+	if err != nil {
+		store.Lock.Unlock()
+		return err
+	}
+
+	config := logQueue.Config
+	store.Lock.Unlock()
+
+	// Messages here are expected to be small, so they are read whole
+	// before taking the lock.
+	content, err := store.ReadContent(ctx, config, message)
+
+	if err != nil {
+		return err
+	}
+
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	if store.Queues[queue.Id] != logQueue {
+		return ErrQueueNotFound
+	}
+
+	usage := &QueueUsage{Messages: int64(logQueue.Ready.Len()), Bytes: logQueue.Bytes}
+	err = store.Check(config, usage, int64(len(content)))
+
+	if err != nil {
+		return err
+	}
+
+	return logQueue.Append(message.Id, content)
+}
+
+func (store *LogStore) FetchMessage(ctx context.Context, queue *Queue) (*Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	logQueue, err := store.Queue(queue, false)
+
+	if err != nil {
+		return nil, nil
+	}
+
+	now := time.Now()
+	config := logQueue.Config
+
+	logQueue.Expire(now)
+
+	for logQueue.Ready.Len() > 0 {
+		element := logQueue.Ready.Front()
+
+		for i := PickReady(store.Peers, logQueue.Ready.Len(), config.Fifo); i > 0; i-- {
+			element = element.Next()
+		}
+
+		entry := element.Value.(*LogEntry)
+
+		if config.Expired(entry.Created, now) {
+			if err = logQueue.Ack(entry); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		deadline := config.LeaseDeadline(store.Visibility, now)
+
+		// A message which can't be set aside stays leased, and is tried
+		// again once its lease runs out.
+		if config.Exhausted(entry.Receives) {
+			if err = store.DeadLetter(ctx, logQueue, entry, config.DeadLetterQueue); err != nil {
+				log.Print("Could not set aside ", entry.Id, " after ", config.MaxReceiveCount, " receives: ", err)
+
+				if err = logQueue.Lease(entry, deadline); err != nil {
+					return nil, err
+				}
+			}
+
+			continue
+		}
+
+		entry.Receives += 1
+
+		if err = logQueue.Lease(entry, deadline); err != nil {
+			entry.Receives -= 1
+			return nil, err
+		}
+
+		message, err := logQueue.Open(entry)
+
+		if err == nil {
+			message.Receipt = Receipt(entry.Deadline)
+		}
+
+		return message, err
+	}
+
+	return nil, nil
+}
+
+// Copies a message into the dead letter queue, if it exists, then
+// acknowledges it. A crash in between leaves a copy in both, never in none.
+// The dead letter queue may keep its messages in files, through the owner.
+func (store *LogStore) DeadLetter(ctx context.Context, logQueue *LogQueue, entry *LogEntry, deadLetterQueue string) error {
+	if deadLetterQueue != "" {
+		content, err := logQueue.Read(entry)
+
+		if err == nil {
+			err = store.Letter(ctx, &Queue{Id: deadLetterQueue}, entry.Id, content)
+		}
+
+		if err != nil && err != ErrQueueNotFound {
+			return err
+		}
+	}
+
+	return logQueue.Ack(entry)
+}
+
+// Adds a message to a queue of this store, or else of its owner. The lock
+// must be held, and is held throughout.
+func (store *LogStore) Letter(ctx context.Context, queue *Queue, id string, content []byte) error {
+	if logQueue, err := store.Queue(queue, false); err == nil {
+		return logQueue.Append(id, content)
+	}
+
+	if store.Owner == nil {
+		return ErrQueueNotFound
+	}
+
+	if err := store.Owner.FetchQueue(ctx, queue); err != nil {
+		return err
+	}
+
+	return store.Owner.SaveMessage(ctx, queue, &Message{
+		Id:   id,
+		Size: int64(len(content)),
+		Body: MemoryBody{bytes.NewReader(content)},
+	})
+}
+
+func (store *LogStore) ReleaseMessage(ctx context.Context, queue *Queue, message *Message) error {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	logQueue, err := store.Queue(queue, false)
+
+	if err != nil {
+		return err
+	}
+
+	entry := logQueue.Leased[message.Id]
+
+	if entry == nil || message.Receipt != Receipt(entry.Deadline) {
+		return ErrLeaseLost
+	}
+
+	return logQueue.Lease(entry, time.Time{})
+}
+
+func (store *LogStore) ExtendMessage(ctx context.Context, queue *Queue, message *Message, visibility time.Duration) error {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	logQueue, err := store.Queue(queue, false)
+
+	if err != nil {
+		return ErrLeaseLost
+	}
+
+	entry := logQueue.Leased[message.Id]
+
+	if entry == nil || message.Receipt != Receipt(entry.Deadline) {
+		return ErrLeaseLost
+	}
+
+	if err = logQueue.Lease(entry, time.Now().Add(visibility)); err != nil {
+		return err
+	}
+
+	message.Receipt = Receipt(entry.Deadline)
+
+	return nil
+}
+
+func (store *LogStore) DeleteMessage(ctx context.Context, queue *Queue, message *Message) error {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	logQueue, err := store.Queue(queue, false)
+
+	if err != nil {
+		return ErrMessageNotFound
+	}
+
+	entry := logQueue.Entries[message.Id]
+
+	if entry == nil {
+		return ErrMessageNotFound
+	}
+
+	// A leased message is only deleted with the receipt of its lease, or
+	// without one once the lease ran out.
+	if logQueue.Leased[entry.Id] != nil {
+		if message.Receipt != Receipt(entry.Deadline) && (message.Receipt != "" || time.Now().Before(entry.Deadline)) {
+			return ErrLeaseLost
+		}
+	} else if message.Receipt != "" {
+		return ErrLeaseLost
+	}
+
+	return logQueue.Ack(entry)
+}
+
+func (store *LogStore) ListMessages(ctx context.Context, queue *Queue) ([]string, error) {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	logQueue, err := store.Queue(queue, false)
+
+	if err != nil {
+		return nil, err
+	}
+
+	messageIds := make([]string, 0, logQueue.Ready.Len())
+
+	for element := logQueue.Ready.Front(); element != nil; element = element.Next() {
+		messageIds = append(messageIds, element.Value.(*LogEntry).Id)
+	}
+
+	return messageIds, nil
+}
+
+func (store *LogStore) StatMessage(ctx context.Context, queue *Queue, message *Message) (*Message, error) {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	logQueue, err := store.Queue(queue, false)
+
+	if err != nil || logQueue.Entries[message.Id] == nil {
+		return nil, ErrMessageNotFound
+	}
+
+	return &Message{Id: message.Id, Size: logQueue.Entries[message.Id].Size}, nil
+}
+
+func (store *LogStore) OpenMessage(ctx context.Context, queue *Queue, message *Message) (*Message, error) {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	logQueue, err := store.Queue(queue, false)
+
+	if err != nil || logQueue.Entries[message.Id] == nil {
+		return nil, ErrMessageNotFound
+	}
+
+	return logQueue.Open(logQueue.Entries[message.Id])
+}
+
+// Every write is synced before it returns, so there is nothing to wait for
+// beyond the lock.
+func (store *LogStore) Close(ctx context.Context) bool {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	for _, logQueue := range store.Queues {
+		for _, segment := range logQueue.Segments {
+			segment.File.Close()
+		}
+
+		logQueue.Index.Close()
+	}
+
+	store.Queues = make(map[string]*LogQueue)
+
+	return true
+}
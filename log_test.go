@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/softlayer/mq/spool"
+	"math"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func setupLog(root string) *LogStore {
+	store := NewLogStore(testPeers, root)
+	store.Visibility = time.Minute
+
+	return store
+}
+
+func TestLogOrder(t *testing.T) {
+	ctx := context.Background()
+
+	store := setupLog(t.TempDir())
+
+	queue := &Queue{Id: queueId, Config: &QueueConfig{Fifo: true}}
+	store.SaveQueue(ctx, queue)
+
+	ids := []string{spool.TimeUUID(), spool.TimeUUID(), spool.TimeUUID()}
+
+	// Saved newest first, and still fetched oldest first.
+	for i := len(ids) - 1; i >= 0; i-- {
+		store.SaveMessage(ctx, queue, newMessage(ids[i], messageContent))
+	}
+
+	first, _ := store.FetchMessage(ctx, queue)
+	first.Body.Close()
+
+	second, _ := store.FetchMessage(ctx, queue)
+	second.Body.Close()
+
+	if first.Id != ids[0] || second.Id != ids[1] {
+		t.Fatal("Messages weren't fetched oldest first")
+	}
+
+	// A released message goes back in front, and one whose lease runs out
+	// first is ready first.
+	store.ReleaseMessage(ctx, queue, first)
+	store.ExtendMessage(ctx, queue, second, time.Millisecond)
+
+	if fetched, _ := store.FetchMessage(ctx, queue); fetched == nil || fetched.Id != ids[0] {
+		t.Fatal("Released message wasn't fetched first")
+	} else {
+		fetched.Body.Close()
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	if fetched, _ := store.FetchMessage(ctx, queue); fetched == nil || fetched.Id != ids[1] {
+		t.Error("Message wasn't ready once its lease ran out")
+	} else {
+		fetched.Body.Close()
+	}
+
+	logQueue, _ := store.Queue(queue, false)
+
+	if logQueue.Ready.Len() != 1 || logQueue.Leases.Len() != 2 || len(logQueue.Leased) != 2 {
+		t.Error("Unexpected ready and leased messages:", logQueue.Ready.Len(), logQueue.Leases.Len(), len(logQueue.Leased))
+	}
+}
+
+func TestLogReplay(t *testing.T) {
+	ctx := context.Background()
+
+	root := t.TempDir()
+	store := setupLog(root)
+
+	queue := &Queue{Id: queueId, Config: &QueueConfig{MaxReceiveCount: 3}}
+	store.SaveQueue(ctx, queue)
+
+	for _, id := range []string{"a", "b", "c"} {
+		store.SaveMessage(ctx, queue, newMessage(id, messageContent))
+	}
+
+	// One message deleted, one leased and one left waiting.
+	store.DeleteMessage(ctx, queue, &Message{Id: "a"})
+	leased, _ := store.FetchMessage(ctx, queue)
+	leased.Body.Close()
+	store.Close(context.Background())
+
+	store = setupLog(root)
+
+	if messageIds, _ := store.ListMessages(ctx, queue); len(messageIds) != 1 || messageIds[0] == leased.Id {
+		t.Error("Unexpected messages after replay", messageIds)
+	}
+
+	logQueue, _ := store.Queue(queue, false)
+
+	if logQueue.Config.MaxReceiveCount != 3 || logQueue.Entries[leased.Id].Receives != 1 {
+		t.Error("Lost the attributes or receive count after replay")
+	}
+
+	if logQueue.Entries["a"] != nil {
+		t.Error("Found deleted message after replay")
+	}
+}
+
+func TestLogSegmentRemoval(t *testing.T) {
+	ctx := context.Background()
+
+	store := setupLog(t.TempDir())
+
+	queue := &Queue{Id: queueId}
+	store.SaveQueue(ctx, queue)
+	store.SaveMessage(ctx, queue, newMessage("a", messageContent))
+
+	logQueue, _ := store.Queue(queue, false)
+	first := logQueue.Active
+
+	// Start a second segment, so the first is no longer active.
+	first.Size = SegmentSize
+	store.SaveMessage(ctx, queue, newMessage("b", messageContent))
+
+	if logQueue.Active == first {
+		t.Fatal("Did not start a new segment")
+	}
+
+	store.DeleteMessage(ctx, queue, &Message{Id: "a"})
+
+	if _, err := os.Stat(first.Path); err == nil {
+		t.Error("Found segment after deleting all of its messages")
+	}
+
+	if _, err := os.Stat(logQueue.Active.Path); err != nil {
+		t.Error("Could not find the active segment")
+	}
+}
+
+func TestLogTornRecord(t *testing.T) {
+	ctx := context.Background()
+
+	root := t.TempDir()
+	store := setupLog(root)
+
+	queue := &Queue{Id: queueId}
+	store.SaveQueue(ctx, queue)
+	store.SaveMessage(ctx, queue, newMessage("a", messageContent))
+	store.SaveMessage(ctx, queue, newMessage("b", messageContent))
+
+	logQueue, _ := store.Queue(queue, false)
+	segmentPath := logQueue.Active.Path
+	size := logQueue.Active.Size
+	store.Close(context.Background())
+
+	// A crash halfway through writing the second record.
+	os.Truncate(segmentPath, size-int64(len(messageContent))/2)
+
+	store = setupLog(root)
+
+	if messageIds, _ := store.ListMessages(ctx, queue); len(messageIds) != 1 || messageIds[0] != "a" {
+		t.Error("Unexpected messages after a torn record", messageIds)
+	}
+
+	// The next message is appended where the intact records end.
+	store.SaveMessage(ctx, queue, newMessage("c", messageContent))
+	store.Close(context.Background())
+
+	store = setupLog(root)
+
+	if messageIds, _ := store.ListMessages(ctx, queue); len(messageIds) != 2 {
+		t.Error("Unexpected messages after appending past a torn record", messageIds)
+	}
+
+	if _, err := os.Stat(path.Join(root, queueId, "index")); err != nil {
+		t.Error("Could not find the index")
+	}
+
+	// A torn header claiming a size so large it would overflow.
+	header := make([]byte, RecordHeaderSize)
+	binary.BigEndian.PutUint16(header[4:6], 1)
+	binary.BigEndian.PutUint64(header[6:14], math.MaxInt64-8)
+
+	logQueue, _ = store.Queue(queue, false)
+	segmentPath = logQueue.Active.Path
+	store.Close(context.Background())
+
+	segment, _ := os.OpenFile(segmentPath, os.O_WRONLY|os.O_APPEND, 0666)
+	segment.Write(header)
+	segment.Close()
+
+	store = setupLog(root)
+
+	if messageIds, _ := store.ListMessages(ctx, queue); len(messageIds) != 2 {
+		t.Error("Unexpected messages after a torn header", messageIds)
+	}
+}
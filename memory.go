@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/softlayer/mq/spool"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The root selecting the memory backend.
+const MemoryRoot = "memory://"
+
+// A backend keeping everything in memory, for ephemeral queues and tests.
+// Messages go through the same lifecycle as on the file system, without the
+// daemons: a saved message is delivered to its queue right away, a fetched
+// one is leased until its visibility runs out, and a deleted one is dropped.
+// Every operation holds a single lock, so the races the file system counts
+// can't happen here.
+type MemoryStore struct {
+	Limits
+	Unretained
+
+	Peers      int
+	Visibility time.Duration
+	Queues     map[string]*MemoryQueue
+	Lock       sync.Mutex
+}
+
+// Ready messages are kept oldest first by the time in their ID, which is
+// Created.
+type MemoryQueue struct {
+	Config *QueueConfig
+	Ready  []*MemoryMessage
+	Leased map[string]*MemoryMessage
+	Bytes  int64
+}
+
+type MemoryMessage struct {
+	Id       string
+	Content  []byte
+	Created  time.Time
+	Deadline time.Time
+	Receives int
+}
+
+// The content of a message held in memory, which can be read and sought
+// like a file.
+type MemoryBody struct {
+	*bytes.Reader
+}
+
+func (body MemoryBody) Close() error {
+	return nil
+}
+
+func NewMemoryStore(peers int) *MemoryStore {
+	store := &MemoryStore{}
+	store.Peers = peers
+	store.Queues = make(map[string]*MemoryQueue)
+
+	return store
+}
+
+func (message *MemoryMessage) Message() *Message {
+	return &Message{
+		Id:   message.Id,
+		Size: int64(len(message.Content)),
+		Body: MemoryBody{bytes.NewReader(message.Content)},
+	}
+}
+
+func (store *MemoryStore) SaveQueue(ctx context.Context, queue *Queue) error {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	memoryQueue := store.Queues[queue.Id]
+
+	if memoryQueue == nil {
+		memoryQueue = &MemoryQueue{
+			Config: &QueueConfig{},
+			Leased: make(map[string]*MemoryMessage),
+		}
+
+		store.Queues[queue.Id] = memoryQueue
+	}
+
+	// Without attributes, whatever the queue had before is kept.
+	if queue.Config != nil {
+		config := *queue.Config
+		memoryQueue.Config = &config
+	}
+
+	return nil
+}
+
+func (store *MemoryStore) FetchQueue(ctx context.Context, queue *Queue) error {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	memoryQueue := store.Queues[queue.Id]
+
+	if memoryQueue == nil {
+		return ErrQueueNotFound
+	}
+
+	config := *memoryQueue.Config
+	queue.Config = &config
+
+	return nil
+}
+
+func (store *MemoryStore) DeleteQueue(ctx context.Context, queue *Queue) error {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	delete(store.Queues, queue.Id)
+
+	return nil
+}
+
+func (store *MemoryStore) SaveMessage(ctx context.Context, queue *Queue, message *Message) error {
+	store.Lock.Lock()
+	memoryQueue := store.Queues[queue.Id]
+
+	if memoryQueue == nil {
+		store.Lock.Unlock()
+		return ErrQueueNotFound
+	}
+
+	config := memoryQueue.Config
+	store.Lock.Unlock()
+
+	content, err := store.ReadContent(ctx, config, message)
+
+	if err != nil {
+		return err
+	}
+
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	// The queue may have gone while we were reading.
+	if store.Queues[queue.Id] != memoryQueue {
+		return ErrQueueNotFound
+	}
+
+	usage := &QueueUsage{Messages: int64(len(memoryQueue.Ready)), Bytes: memoryQueue.Bytes}
+	err = store.Check(config, usage, int64(len(content)))
+
+	if err != nil {
+		return err
+	}
+
+	memoryQueue.MakeReady(&MemoryMessage{Id: message.Id, Content: content, Created: spool.UUIDTime(message.Id)})
+
+	return nil
+}
+
+// Adds a message to the ready ones, after those created no later.
+func (memoryQueue *MemoryQueue) MakeReady(message *MemoryMessage) {
+	i := sort.Search(len(memoryQueue.Ready), func(i int) bool {
+		return message.Created.Before(memoryQueue.Ready[i].Created)
+	})
+
+	memoryQueue.Ready = append(memoryQueue.Ready, nil)
+	copy(memoryQueue.Ready[i+1:], memoryQueue.Ready[i:])
+	memoryQueue.Ready[i] = message
+	memoryQueue.Bytes += int64(len(message.Content))
+}
+
+// Takes the i-th message out of the ready ones.
+func (memoryQueue *MemoryQueue) Unready(i int) *MemoryMessage {
+	message := memoryQueue.Ready[i]
+	memoryQueue.Ready = append(memoryQueue.Ready[:i], memoryQueue.Ready[i+1:]...)
+	memoryQueue.Bytes -= int64(len(message.Content))
+
+	return message
+}
+
+func (store *MemoryStore) FetchMessage(ctx context.Context, queue *Queue) (*Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	memoryQueue := store.Queues[queue.Id]
+
+	if memoryQueue == nil {
+		return nil, nil
+	}
+
+	now := time.Now()
+	config := memoryQueue.Config
+
+	// Leases which ran out are re-delivered, as the mover would.
+	for id, message := range memoryQueue.Leased {
+		if now.After(message.Deadline) {
+			delete(memoryQueue.Leased, id)
+			memoryQueue.MakeReady(message)
+		}
+	}
+
+	for len(memoryQueue.Ready) > 0 {
+		message := memoryQueue.Unready(PickReady(store.Peers, len(memoryQueue.Ready), config.Fifo))
+
+		if config.Expired(message.Created, now) {
+			continue
+		}
+
+		if config.Exhausted(message.Receives) {
+			if deadLetterQueue := store.Queues[config.DeadLetterQueue]; deadLetterQueue != nil {
+				message.Receives = 0
+				deadLetterQueue.MakeReady(message)
+			}
+
+			continue
+		}
+
+		message.Receives += 1
+		message.Deadline = config.LeaseDeadline(store.Visibility, now)
+		memoryQueue.Leased[message.Id] = message
+
+		fetched := message.Message()
+		fetched.Receipt = Receipt(message.Deadline)
+
+		return fetched, nil
+	}
+
+	return nil, nil
+}
+
+func (store *MemoryStore) ReleaseMessage(ctx context.Context, queue *Queue, message *Message) error {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	leased := store.Leased(queue, message)
+
+	if leased == nil {
+		return ErrLeaseLost
+	}
+
+	memoryQueue := store.Queues[queue.Id]
+	delete(memoryQueue.Leased, message.Id)
+	memoryQueue.MakeReady(leased)
+
+	return nil
+}
+
+func (store *MemoryStore) ExtendMessage(ctx context.Context, queue *Queue, message *Message, visibility time.Duration) error {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	leased := store.Leased(queue, message)
+
+	if leased == nil {
+		return ErrLeaseLost
+	}
+
+	leased.Deadline = time.Now().Add(visibility)
+	message.Receipt = Receipt(leased.Deadline)
+
+	return nil
+}
+
+// Finds a message under the lease its receipt is of. The lock must be held.
+func (store *MemoryStore) Leased(queue *Queue, message *Message) *MemoryMessage {
+	memoryQueue := store.Queues[queue.Id]
+
+	if memoryQueue == nil {
+		return nil
+	}
+
+	leased := memoryQueue.Leased[message.Id]
+
+	if leased == nil || message.Receipt != Receipt(leased.Deadline) {
+		return nil
+	}
+
+	return leased
+}
+
+func (store *MemoryStore) DeleteMessage(ctx context.Context, queue *Queue, message *Message) error {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	memoryQueue := store.Queues[queue.Id]
+
+	if memoryQueue == nil {
+		return ErrMessageNotFound
+	}
+
+	// A leased message is only deleted with the receipt of its lease, or
+	// without one once the lease ran out.
+	if leased := memoryQueue.Leased[message.Id]; leased != nil {
+		if message.Receipt != Receipt(leased.Deadline) && (message.Receipt != "" || time.Now().Before(leased.Deadline)) {
+			return ErrLeaseLost
+		}
+
+		delete(memoryQueue.Leased, message.Id)
+		return nil
+	}
+
+	if message.Receipt != "" {
+		return ErrLeaseLost
+	}
+
+	for i, ready := range memoryQueue.Ready {
+		if ready.Id == message.Id {
+			memoryQueue.Unready(i)
+			return nil
+		}
+	}
+
+	return ErrMessageNotFound
+}
+
+func (store *MemoryStore) ListMessages(ctx context.Context, queue *Queue) ([]string, error) {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	memoryQueue := store.Queues[queue.Id]
+
+	if memoryQueue == nil {
+		return nil, ErrQueueNotFound
+	}
+
+	messageIds := make([]string, len(memoryQueue.Ready))
+
+	for i, message := range memoryQueue.Ready {
+		messageIds[i] = message.Id
+	}
+
+	return messageIds, nil
+}
+
+// Finds a message in its queue or among the leased ones.
+func (store *MemoryStore) Find(queue *Queue, message *Message) *MemoryMessage {
+	memoryQueue := store.Queues[queue.Id]
+
+	if memoryQueue == nil {
+		return nil
+	}
+
+	if leased := memoryQueue.Leased[message.Id]; leased != nil {
+		return leased
+	}
+
+	for _, ready := range memoryQueue.Ready {
+		if ready.Id == message.Id {
+			return ready
+		}
+	}
+
+	return nil
+}
+
+func (store *MemoryStore) StatMessage(ctx context.Context, queue *Queue, message *Message) (*Message, error) {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	found := store.Find(queue, message)
+
+	if found == nil {
+		return nil, ErrMessageNotFound
+	}
+
+	return &Message{Id: found.Id, Size: int64(len(found.Content))}, nil
+}
+
+func (store *MemoryStore) OpenMessage(ctx context.Context, queue *Queue, message *Message) (*Message, error) {
+	store.Lock.Lock()
+	defer store.Lock.Unlock()
+
+	found := store.Find(queue, message)
+
+	if found == nil {
+		return nil, ErrMessageNotFound
+	}
+
+	return found.Message(), nil
+}
+
+// Nothing is ever written anywhere, so there is nothing to wait for.
+func (store *MemoryStore) Close(ctx context.Context) bool {
+	return true
+}
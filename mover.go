@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"github.com/softlayer/mq/spool"
+	"log"
+	"os"
+	"path"
+	"time"
+)
+
+// Does the work of mq-mover within mq: delivers new messages to their queues
+// as soon as they are written, and delayed messages once their lease is over.
+// It shares the store's folders, visibility and sharding, so nothing needs to
+// be configured twice.
+func (store *Store) PrepareMover() {
+	store.Follow(store.NewFolder, 0, func(file string) {
+		store.Count(&store.Delivered, store.MoveToQueue(file))
+	})
+
+	store.Follow(store.DelayFolder, store.Visibility, func(file string) {
+		store.Count(&store.Requeued, store.MoveToQueue(file))
+	})
+}
+
+// Does the work of mq-reaper within mq: unlinks removed messages, right away
+// unless they are retained.
+func (store *Store) PrepareReaper() {
+	if store.Retain > 0 || store.RetainBytes > 0 {
+		store.Working.Add(1)
+		go store.Pruner()
+		return
+	}
+
+	store.Follow(store.RemoveFolder, 0, func(file string) {
+		store.Count(&store.Reaped, os.Remove(file))
+	})
+}
+
+// Prunes the remove folder every Prune until the store is closed.
+func (store *Store) Pruner() {
+	defer store.Working.Done()
+
+	ticker := time.NewTicker(store.Prune)
+	defer ticker.Stop()
+
+	for {
+		store.PruneRetained()
+
+		select {
+		case <-ticker.C:
+		case <-store.Quit:
+			return
+		}
+	}
+}
+
+// Unlinks retained messages, oldest removed first, until none is older than
+// Retain and together they take up no more than RetainBytes.
+func (store *Store) PruneRetained() {
+	spool.Prune(store.RemoveFolder, store.Retain, store.RetainBytes, func(file string) {
+		store.Count(&store.Reaped, os.Remove(file))
+	})
+}
+
+// Counts what became of a file: done counts towards the given counter, any
+// other outcome towards its own.
+func (store *Store) Count(done *int, err error) {
+	store.MovesLock.Lock()
+	defer store.MovesLock.Unlock()
+
+	switch {
+	case err == nil:
+		*done += 1
+	case err == ErrInvalidName:
+		store.Quarantined += 1
+	case os.IsNotExist(err):
+		store.Vanished += 1
+	default:
+		log.Print(err)
+		store.Failed += 1
+	}
+}
+
+// Logs what the embedded mover and reaper did, if they ran.
+func (store *Store) LogMoves() {
+	if len(store.Watches) == 0 {
+		return
+	}
+
+	log.Print(store.Moves())
+}
+
+// Describes what the embedded mover and reaper did so far.
+func (store *Store) Moves() string {
+	store.MovesLock.Lock()
+	defer store.MovesLock.Unlock()
+
+	return fmt.Sprintf("Moved %s: %d delivered, %d requeued, %d reaped, %d quarantined, %d vanished, %d failed",
+		store.Root, store.Delivered, store.Requeued, store.Reaped, store.Quarantined, store.Vanished, store.Failed)
+}
+
+// Logs what the embedded mover and reaper did every Report while they run, as
+// mq-mover does, rather than only when the store is closed.
+func (store *Store) PrepareReporter() {
+	if store.Report <= 0 {
+		return
+	}
+
+	store.Working.Add(1)
+	go store.Reporter()
+}
+
+// Logs the moves every Report until the store is closed, whenever any of them
+// changed since the last time.
+func (store *Store) Reporter() {
+	defer store.Working.Done()
+
+	ticker := time.NewTicker(store.Report)
+	defer ticker.Stop()
+
+	reported := store.Moves()
+
+	for {
+		select {
+		case <-ticker.C:
+			if moves := store.Moves(); moves != reported {
+				log.Print(moves)
+				reported = moves
+			}
+		case <-store.Quit:
+			return
+		}
+	}
+}
+
+// Watches a folder until the store is closed, calling handle for every file
+// once it is due. Files are handled one at a time.
+func (store *Store) Follow(folder string, delay time.Duration, handle func(file string)) {
+	watch := &spool.Watch{
+		Delay:     delay,
+		Sweep:     store.Sweep,
+		Directory: folder,
+		Quit:      store.Quit,
+	}
+
+	if err := watch.Run(); err != nil {
+		log.Fatal(err)
+	}
+
+	store.Watches = append(store.Watches, watch)
+
+	store.Working.Add(1)
+
+	go func() {
+		defer store.Working.Done()
+
+		for {
+			select {
+			case file := <-watch.Files:
+				handle(file)
+			case <-store.Quit:
+				return
+			}
+		}
+	}()
+}
+
+// Moves a new or delayed message file into its queue. A file which isn't
+// named queue:id is moved to the invalid folder instead, and ErrInvalidName
+// returned. A file which is gone was moved along already, or deleted.
+func (store *Store) MoveToQueue(file string) error {
+	queue, message := ParseMessageFile(path.Base(file))
+
+	if queue == nil {
+		return store.Quarantine(file)
+	}
+
+	return store.Deliver(file, queue, message.Id)
+}
+
+// Moves a file which isn't a message out of the way, to be looked at by
+// someone rather than retried forever or silently lost.
+func (store *Store) Quarantine(file string) error {
+	log.Print("Quarantining ", file, ", which is not named queue:id")
+
+	if err := store.Rename(file, path.Join(store.InvalidFolder, path.Base(file))); err != nil {
+		return err
+	}
+
+	return ErrInvalidName
+}
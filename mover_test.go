@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/go.exp/inotify"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Waits for a file to appear or disappear, for up to a second.
+func waitFile(file string, exists bool) bool {
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(file); (err == nil) == exists {
+			return true
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return false
+}
+
+func TestEmbeddedMover(t *testing.T) {
+	ctx := context.Background()
+
+	store := setup(t)
+	store.Visibility = 50 * time.Millisecond
+	store.PrepareMover()
+	store.PrepareReaper()
+
+	queue := &Queue{Id: queueId}
+	store.SaveQueue(ctx, queue)
+
+	message := newMessage(messageId, messageContent)
+	store.SaveMessage(ctx, queue, message)
+
+	queuePath := path.Join(store.QueuesFolder, queueId, messageId)
+
+	if !waitFile(queuePath, true) {
+		t.Fatal("New message wasn't delivered")
+	}
+
+	fetched, _ := store.FetchMessage(ctx, queue)
+	fetched.Body.Close()
+
+	// The lease runs out without the message being deleted.
+	if !waitFile(queuePath, true) {
+		t.Fatal("Delayed message wasn't re-delivered")
+	}
+
+	fetched, _ = store.FetchMessage(ctx, queue)
+	fetched.Body.Close()
+	store.DeleteMessage(ctx, queue, fetched)
+
+	if !waitFile(path.Join(store.RemoveFolder, queueId+":"+messageId), false) {
+		t.Error("Removed message wasn't unlinked")
+	}
+
+	store.Close(ctx)
+
+	if store.Delivered != 1 || store.Requeued != 1 || store.Reaped != 1 {
+		t.Error("Unexpected mover counts", store.Delivered, store.Requeued, store.Reaped)
+	}
+
+	if files, _ := ioutil.ReadDir(store.DelayFolder); len(files) != 0 {
+		t.Error("Found delayed message after deleting it")
+	}
+}
+
+func TestMoverCatchUp(t *testing.T) {
+	store := setup(t)
+	store.Visibility = 50 * time.Millisecond
+	store.Sweep = 50 * time.Millisecond
+
+	store.SaveQueue(context.Background(), &Queue{Id: queueId})
+
+	// Both were left behind while nothing was watching, and the lease of
+	// the delayed one is long over.
+	ioutil.WriteFile(path.Join(store.NewFolder, queueId+":new"), messageContent, 0666)
+	delayPath := path.Join(store.DelayFolder, queueId+":delayed")
+	ioutil.WriteFile(delayPath, messageContent, 0666)
+	os.Chtimes(delayPath, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour))
+
+	store.PrepareMover()
+
+	if !waitFile(path.Join(store.QueuesFolder, queueId, "new"), true) || !waitFile(path.Join(store.QueuesFolder, queueId, "delayed"), true) {
+		t.Error("Message left behind wasn't delivered")
+	}
+
+	// Written in place, so no event announces it. Only a sweep finds it.
+	ioutil.WriteFile(path.Join(store.NewFolder, queueId+":swept"), messageContent, 0666)
+
+	if !waitFile(path.Join(store.QueuesFolder, queueId, "swept"), true) {
+		t.Error("Message without an event wasn't swept")
+	}
+
+	store.Close(context.Background())
+}
+
+func TestWatchOverflow(t *testing.T) {
+	store := setup(t)
+	store.SaveQueue(context.Background(), &Queue{Id: queueId})
+	store.PrepareMover()
+
+	// Written in place, so no event announces it, as if it were dropped.
+	ioutil.WriteFile(path.Join(store.NewFolder, queueId+":dropped"), messageContent, 0666)
+	store.Watches[0].Handle(&inotify.Event{Mask: inotify.IN_Q_OVERFLOW})
+
+	if !waitFile(path.Join(store.QueuesFolder, queueId, "dropped"), true) {
+		t.Error("Message wasn't delivered after an overflow")
+	}
+
+	store.Close(context.Background())
+
+	if store.Watches[0].Overflows != 1 {
+		t.Error("Overflow wasn't counted")
+	}
+}
+
+func TestDelaySchedule(t *testing.T) {
+	store := setup(t)
+	store.Visibility = time.Hour
+	store.SaveQueue(context.Background(), &Queue{Id: queueId})
+
+	// Fetched an hour ago, before a restart, so only the rest of the delay
+	// is left to wait.
+	latePath := path.Join(store.DelayFolder, queueId+":late")
+	ioutil.WriteFile(latePath, messageContent, 0666)
+	os.Chtimes(latePath, time.Now().Add(-time.Hour+100*time.Millisecond), time.Now().Add(-time.Hour+100*time.Millisecond))
+
+	// Leased for a while yet.
+	leasedPath := path.Join(store.DelayFolder, queueId+":leased")
+	ioutil.WriteFile(leasedPath, messageContent, 0666)
+	os.Chtimes(leasedPath, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+
+	store.PrepareMover()
+
+	if !waitFile(path.Join(store.QueuesFolder, queueId, "late"), true) {
+		t.Error("Delayed message wasn't re-delivered once due")
+	}
+
+	watch := store.Watches[1]
+	watch.Lock.Lock()
+	held := watch.Held.Len()
+	watch.Lock.Unlock()
+
+	if _, err := os.Stat(leasedPath); err != nil || held != 1 {
+		t.Error("Leased message wasn't held", held)
+	}
+
+	store.Close(context.Background())
+}
+
+func TestVisibilityTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	store := setup(t)
+	store.Visibility = time.Hour
+
+	queue := &Queue{Id: queueId, Config: &QueueConfig{VisibilityTimeout: 1}}
+	store.SaveQueue(ctx, queue)
+	ioutil.WriteFile(path.Join(store.QueuesFolder, queueId, messageId), messageContent, 0666)
+	store.PrepareMover()
+
+	fetched, _ := store.FetchMessage(ctx, queue)
+
+	if fetched == nil {
+		t.Fatal("Could not fetch message")
+	}
+
+	fetched.Body.Close()
+
+	// The queue's timeout is stamped on the lease, rather than the
+	// mover's delay being waited for.
+	info, err := os.Stat(path.Join(store.DelayFolder, queueId+":"+messageId))
+
+	if err != nil || info.ModTime().Before(time.Now()) || info.ModTime().After(time.Now().Add(time.Second)) {
+		t.Error("Lease wasn't stamped with the queue's visibility timeout")
+	}
+
+	// Waited for twice, as the lease itself lasts about as long as one wait.
+	if !waitFile(path.Join(store.QueuesFolder, queueId, messageId), true) && !waitFile(path.Join(store.QueuesFolder, queueId, messageId), true) {
+		t.Error("Message wasn't re-delivered once the queue's visibility timeout ran out")
+	}
+
+	store.Close(ctx)
+}
+
+func TestMoverQuarantine(t *testing.T) {
+	store := setup(t)
+	store.SaveQueue(context.Background(), &Queue{Id: queueId})
+
+	// Neither is named queue:id, so neither can be delivered.
+	ioutil.WriteFile(path.Join(store.NewFolder, "stray"), messageContent, 0666)
+	ioutil.WriteFile(path.Join(store.DelayFolder, queueId+":"), messageContent, 0666)
+
+	store.PrepareMover()
+
+	if !waitFile(path.Join(store.InvalidFolder, "stray"), true) || !waitFile(path.Join(store.InvalidFolder, queueId+":"), true) {
+		t.Error("Misnamed file wasn't quarantined")
+	}
+
+	store.Close(context.Background())
+
+	if store.Quarantined != 2 || store.Delivered != 0 || store.Requeued != 0 || store.Failed != 0 {
+		t.Error("Unexpected mover counts", store.Quarantined, store.Delivered, store.Requeued, store.Failed)
+	}
+}
+
+func TestMoverReport(t *testing.T) {
+	var output bytes.Buffer
+
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	store := setup(t)
+	store.Report = 10 * time.Millisecond
+	store.PrepareMover()
+	store.PrepareReporter()
+
+	queue := &Queue{Id: queueId}
+	store.SaveQueue(context.Background(), queue)
+	store.SaveMessage(context.Background(), queue, newMessage(messageId, messageContent))
+
+	if !waitFile(path.Join(store.QueuesFolder, queueId, messageId), true) {
+		t.Fatal("New message wasn't delivered")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	store.Close(context.Background())
+
+	// Logged once while running and once more when closed, but never before
+	// anything was moved.
+	if strings.Count(output.String(), " 1 delivered") != 2 || strings.Contains(output.String(), " 0 delivered") {
+		t.Error("Unexpected reports", output.String())
+	}
+}
+
+func TestReaperRetention(t *testing.T) {
+	store := setup(t)
+	store.Retain = time.Hour
+	store.RetainBytes = int64(len(messageContent))
+
+	write := func(file string, age time.Duration) string {
+		filePath := path.Join(store.RemoveFolder, file)
+		ioutil.WriteFile(filePath, messageContent, 0666)
+		os.Chtimes(filePath, time.Now().Add(-age), time.Now().Add(-age))
+		return filePath
+	}
+
+	expired := write(queueId+":expired", 2*time.Hour)
+	older := write(queueId+":older", 2*time.Minute)
+	newer := write(queueId+":newer", time.Minute)
+
+	// Retained messages aren't unlinked as they arrive.
+	store.PrepareReaper()
+	store.Close(context.Background())
+
+	// One is past the window, and one more is past the size cap.
+	for _, gone := range []string{expired, older} {
+		if _, err := os.Stat(gone); err == nil {
+			t.Error("Found", gone, "after pruning")
+		}
+	}
+
+	if _, err := os.Stat(newer); err != nil || store.Reaped != 2 {
+		t.Error("Unexpected pruning", store.Reaped)
+	}
+}
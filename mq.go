@@ -1,28 +1,52 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 )
 
 var (
-	workers int
-	peers   int
-	root    string
-	port    string
-	address string
+	workers          int
+	backlog          int
+	workerTimeout    time.Duration
+	peers            int
+	root             string
+	port             string
+	address          string
+	maxMessageSize   int64
+	maxQueueMessages int64
+	maxQueueBytes    int64
+	drainTimeout     time.Duration
+	visibility       time.Duration
+	shard            time.Duration
+	indexed          bool
+	durability       string
+	embeddedMover    bool
+	embeddedReaper   bool
+	sweep            time.Duration
+	report           time.Duration
+	retain           time.Duration
+	retainBytes      int64
+	prune            time.Duration
+	reconcile        time.Duration
 )
 
 type FrontHandler struct {
-	Store     *Store
+	Store     Backend
 	Router    *Router
 	Endpoints map[string]func(*Session)
 }
 
 type Session struct {
-	Store    *Store
+	Store    Backend
 	Match    *RouteMatch
 	Request  *http.Request
 	Response http.ResponseWriter
@@ -46,30 +70,20 @@ func (handler *FrontHandler) ServeHTTP(response http.ResponseWriter, request *ht
 	response.WriteHeader(http.StatusNotFound)
 }
 
-func init() {
-	flag.IntVar(&workers, "workers", 8, "Number of workers")
-	flag.IntVar(&peers, "peers", 0, "Number of peers")
-	flag.StringVar(&root, "root", "/tmp/mq", "File system storage path")
-	flag.StringVar(&port, "port", "8080", "Port to listen on")
-	flag.StringVar(&address, "address", "0.0.0.0", "Address to listen on")
-	flag.Parse()
-}
-
-func main() {
-	store := NewStore(workers, peers, root)
-
-	// Our storage mechanism needs to make sure our folders
-	// and workers are standing up.
-	store.PrepareFolders()
-	store.PrepareWorkers()
-
+// Routes every endpoint to the given backend.
+func NewFrontHandler(store Backend) *FrontHandler {
 	router := &Router{}
 	router.AddRoute("GetQueue", "GET", "^/(?P<queue>[a-z]+)$")
 	router.AddRoute("CreateQueue", "PUT", "^/(?P<queue>[a-z]+)$")
 	router.AddRoute("DeleteQueue", "DELETE", "^/(?P<queue>[a-z]+)$")
 	router.AddRoute("CreateMessage", "POST", "^/(?P<queue>[a-z]+)/messages$")
 	router.AddRoute("GetMessage", "GET", "^/(?P<queue>[a-z]+)/messages$")
+	router.AddRoute("PeekMessage", "GET", "^/(?P<queue>[a-z]+)/messages/(?P<message>[a-z0-9-]+)$")
 	router.AddRoute("DeleteMessage", "DELETE", "^/(?P<queue>[a-z]+)/messages/(?P<message>[a-z0-9-]+)$")
+	router.AddRoute("ExtendLease", "PUT", "^/(?P<queue>[a-z]+)/messages/(?P<message>[a-z0-9-]+)/lease$")
+	router.AddRoute("ReleaseLease", "DELETE", "^/(?P<queue>[a-z]+)/messages/(?P<message>[a-z0-9-]+)/lease$")
+	router.AddRoute("ReplayMessage", "POST", "^/(?P<queue>[a-z]+)/messages/(?P<message>[a-z0-9-]+)/replay$")
+	router.AddRoute("ReplayMessages", "POST", "^/(?P<queue>[a-z]+)/replay$")
 
 	handler := &FrontHandler{
 		Store:     store,
@@ -84,7 +98,133 @@ func main() {
 	handler.Endpoints["DeleteQueue"] = DeleteQueue
 	handler.Endpoints["CreateMessage"] = CreateMessage
 	handler.Endpoints["GetMessage"] = GetMessage
+	handler.Endpoints["PeekMessage"] = PeekMessage
 	handler.Endpoints["DeleteMessage"] = DeleteMessage
+	handler.Endpoints["ExtendLease"] = ExtendLease
+	handler.Endpoints["ReleaseLease"] = ReleaseLease
+	handler.Endpoints["ReplayMessage"] = ReplayMessage
+	handler.Endpoints["ReplayMessages"] = ReplayMessages
+
+	return handler
+}
+
+func init() {
+	flag.IntVar(&workers, "workers", 8, "Number of workers")
+	flag.IntVar(&backlog, "backlog", DefaultBacklog, "Number of requests allowed to wait for each worker")
+	flag.DurationVar(&workerTimeout, "worker-timeout", 10*time.Second, "Time allowed for a worker to answer a request, 0 for unlimited")
+	flag.IntVar(&peers, "peers", 0, "Number of peers")
+	flag.StringVar(&root, "root", "/tmp/mq", "File system storage path")
+	flag.StringVar(&port, "port", "8080", "Port to listen on")
+	flag.StringVar(&address, "address", "0.0.0.0", "Address to listen on")
+	flag.Int64Var(&maxMessageSize, "max-message-size", 0, "Largest message in bytes, 0 for unlimited")
+	flag.Int64Var(&maxQueueMessages, "max-queue-messages", 0, "Most messages waiting in a queue, 0 for unlimited")
+	flag.Int64Var(&maxQueueBytes, "max-queue-bytes", 0, "Most bytes waiting in a queue, 0 for unlimited")
+	flag.DurationVar(&visibility, "visibility", 30*time.Second, "Time a fetched message stays delayed, as set on the mover")
+	flag.DurationVar(&shard, "shard", 0, "Interval to bucket queue folders by, as set on the mover")
+	flag.StringVar(&durability, "durability", "strict", "Flush folders after every create and move (strict) or leave it to the system (relaxed)")
+	flag.BoolVar(&indexed, "index", false, "Keep the messages ready in each queue in memory")
+	flag.DurationVar(&reconcile, "reconcile", time.Minute, "Interval to scan indexed queues again at")
+	flag.BoolVar(&embeddedMover, "embedded-mover", false, "Deliver new and delayed messages within mq, instead of mq-mover")
+	flag.BoolVar(&embeddedReaper, "embedded-reaper", false, "Unlink removed messages within mq, instead of mq-reaper")
+	flag.DurationVar(&sweep, "sweep", time.Minute, "Interval the embedded mover and reaper sweep their folders at, 0 for never")
+	flag.DurationVar(&report, "report", time.Minute, "Interval to log what the embedded mover and reaper did at, if anything changed, 0 for never")
+	flag.DurationVar(&retain, "retain", 0, "Time the embedded reaper keeps removed messages for replay, 0 for none")
+	flag.Int64Var(&retainBytes, "retain-bytes", 0, "Most bytes of removed messages the embedded reaper keeps for replay, 0 for unlimited")
+	flag.DurationVar(&prune, "prune", DefaultPrune, "Interval the embedded reaper unlinks retained messages beyond -retain and -retain-bytes at")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 30*time.Second, "Time allowed to finish requests when stopping")
+}
+
+// Picks the backend named by the root: in memory, or a file system path.
+func NewBackend() Backend {
+	limits := Limits{
+		MaxMessageSize:   maxMessageSize,
+		MaxQueueMessages: maxQueueMessages,
+		MaxQueueBytes:    maxQueueBytes,
+	}
+
+	if root == MemoryRoot {
+		store := NewMemoryStore(peers)
+		store.Limits = limits
+		store.Visibility = visibility
+
+		return store
+	}
+
+	if strings.HasPrefix(root, LogScheme) {
+		store := NewLogStore(peers, strings.TrimPrefix(root, LogScheme))
+		store.Limits = limits
+		store.Visibility = visibility
+
+		return store
+	}
+
+	if strings.HasPrefix(root, SqliteScheme) {
+		store, err := NewSqliteStore(peers, limits, visibility, strings.TrimPrefix(root, SqliteScheme))
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return store
+	}
+
+	store := NewStore(workers, peers, root)
+	store.Limits = limits
+	store.Visibility = visibility
+	store.Shard = shard
+	store.Strict = durability == "strict"
+	store.Sweep = sweep
+	store.Report = report
+	store.Retain = retain
+	store.RetainBytes = retainBytes
+	store.Prune = prune
+	store.Backlog = backlog
+	store.WorkerTimeout = workerTimeout
+
+	// Our storage mechanism needs to make sure our folders
+	// and workers are standing up, and that whatever a crash
+	// left behind is dealt with before serving anyone.
+	store.PrepareFolders()
+	store.Recover()
+	store.PrepareWorkers()
+
+	if indexed {
+		store.PrepareIndex(reconcile)
+	}
+
+	if embeddedMover {
+		store.PrepareMover()
+	}
+
+	if embeddedReaper {
+		store.PrepareReaper()
+	}
+
+	if embeddedMover || embeddedReaper {
+		store.PrepareReporter()
+	}
+
+	return store
+}
+
+func main() {
+	flag.Parse()
+
+	if durability != "strict" && durability != "relaxed" {
+		log.Fatal("Unknown durability ", durability)
+	}
+
+	if prune <= 0 {
+		log.Fatal("Prune interval must be positive")
+	}
+
+	store := NewBackend()
+
+	handler := NewFrontHandler(store)
+
+	// Every request's context derives from this one, so requests still
+	// waiting on the store when we stop can be abandoned at once.
+	serving, abandon := context.WithCancel(context.Background())
 
 	server := &http.Server{
 		Addr:           address + ":" + port,
@@ -92,7 +232,38 @@ func main() {
 		ReadTimeout:    120 * time.Second,
 		WriteTimeout:   120 * time.Second,
 		MaxHeaderBytes: 1 << 20,
+		BaseContext: func(net.Listener) context.Context {
+			return serving
+		},
+	}
+
+	go func() {
+		err := server.ListenAndServe()
+
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	log.Print("Received ", <-signals, ", draining requests")
+
+	// Stop accepting connections and wait for the requests in flight, then
+	// for the workers serving them. Whatever is still being written when
+	// time runs out is removed by the store.
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	drained := server.Shutdown(ctx) == nil
+	abandon()
+	drained = store.Close(ctx) && drained
+
+	if !drained {
+		log.Print("Could not drain requests within ", drainTimeout)
+		os.Exit(1)
 	}
 
-	log.Println(server.ListenAndServe())
+	log.Print("Drained requests")
 }
@@ -0,0 +1,13 @@
+//go:build !sqlite
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// Without the sqlite build tag, the SQLite driver isn't linked in.
+func NewSqliteStore(peers int, limits Limits, visibility time.Duration, file string) (Backend, error) {
+	return nil, errors.New("built without SQLite support, rebuild with -tags sqlite")
+}
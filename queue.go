@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/softlayer/mq/spool"
+	"time"
+)
+
+// The name of the file, inside each queue's folder, holding its attributes.
+// Like every other dot-file in a queue's folder, it is never fetched as a
+// message.
+const ConfigFile = ".config"
+
+type Queue struct {
+	Id     string
+	Config *QueueConfig
+}
+
+// Attributes a queue may set for itself. Every attribute is optional and its
+// zero value means the server-wide behavior applies.
+type QueueConfig struct {
+	// Seconds a fetched message stays hidden before being re-delivered.
+	VisibilityTimeout int `json:"visibility_timeout"`
+
+	// Largest message body, in bytes, the queue will accept.
+	MaxMessageSize int64 `json:"max_message_size"`
+
+	// Most messages, and their bytes, the queue will hold while they wait
+	// to be fetched.
+	MaxMessages int64 `json:"max_messages"`
+	MaxBytes    int64 `json:"max_bytes"`
+
+	// Seconds a message may live, measured from its creation, before it is
+	// discarded instead of being delivered.
+	Retention int `json:"retention"`
+
+	// Deliveries a message gets before it is moved to the dead letter queue,
+	// or discarded if there is none or it doesn't exist.
+	MaxReceiveCount int `json:"max_receive_count"`
+
+	// The queue receiving messages which exceeded their receive count.
+	DeadLetterQueue string `json:"dead_letter_queue"`
+
+	// Deliver messages strictly oldest first, ignoring peers.
+	Fifo bool `json:"fifo"`
+
+	// How the file system backend keeps the queue's messages: a file per
+	// message when empty, or appended to segments with "log".
+	Storage string `json:"storage"`
+}
+
+// Whether a message created at the given time outlived the queue's retention,
+// and is discarded rather than delivered.
+func (config *QueueConfig) Expired(created time.Time, now time.Time) bool {
+	return config.Retention > 0 && now.Sub(created) > time.Duration(config.Retention)*time.Second
+}
+
+// Whether a message delivered this many times already is set aside rather
+// than delivered again: to the dead letter queue, or discarded when there is
+// none or it doesn't exist.
+func (config *QueueConfig) Exhausted(receives int) bool {
+	return config.MaxReceiveCount > 0 && receives >= config.MaxReceiveCount
+}
+
+// When a lease taken now runs out: after the queue's visibility timeout, or
+// else the server's.
+func (config *QueueConfig) LeaseDeadline(visibility time.Duration, now time.Time) time.Time {
+	if config.VisibilityTimeout > 0 {
+		return now.Add(time.Duration(config.VisibilityTimeout) * time.Second)
+	}
+
+	return now.Add(visibility)
+}
+
+func (config *QueueConfig) Valid(queue *Queue) bool {
+	if config.VisibilityTimeout < 0 || config.MaxMessageSize < 0 || config.MaxMessages < 0 || config.MaxBytes < 0 || config.Retention < 0 || config.MaxReceiveCount < 0 {
+		return false
+	}
+
+	if config.Storage != "" && config.Storage != "log" {
+		return false
+	}
+
+	if config.DeadLetterQueue != "" {
+		if !spool.QueueName.MatchString(config.DeadLetterQueue) || config.DeadLetterQueue == queue.Id {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"github.com/softlayer/mq/spool"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// How long a staged message goes without being written to before recovery
+// takes it for abandoned. Requests are given 2 minutes to send their body, so
+// a message still being written, by us or a peer, was written to since.
+const StagingLifetime = 10 * time.Minute
+
+// What a recovery pass found and did.
+type Recovery struct {
+	Delivered  int
+	Requeued   int
+	Removed    int
+	RolledBack int
+	Orphaned   int
+	Invalid    int
+}
+
+// Splits a message file name, queue:id, into its queue and message. Returns
+// nil for anything else.
+func ParseMessageFile(name string) (*Queue, *Message) {
+	queueId, messageId, ok := spool.ParseMessageFile(name)
+
+	if !ok {
+		return nil, nil
+	}
+
+	return &Queue{Id: queueId}, &Message{Id: messageId}
+}
+
+// Brings the folders back to a consistent state after a crash, before any
+// request is served. Since every step of a message's lifecycle is a rename,
+// the only damage is work left undone: messages half written in staging,
+// messages nobody moved along, messages found in more than one place on file
+// systems without atomic renames, and messages of queues which no longer
+// exist.
+func (store *Store) Recover() *Recovery {
+	recovery := &Recovery{}
+
+	// A staged message was never completely written, or never handed
+	// over, so it was never acknowledged either. One written to recently
+	// may still be in the works of a peer sharing the root.
+	if infos, err := ioutil.ReadDir(store.StagingFolder); err == nil {
+		for _, info := range infos {
+			if time.Since(info.ModTime()) > StagingLifetime && os.Remove(path.Join(store.StagingFolder, info.Name())) == nil {
+				recovery.RolledBack += 1
+			}
+		}
+	}
+
+	// A message being removed wins over any other copy of it, so that
+	// removal is finished.
+	store.RecoverFolder(store.RemoveFolder, recovery, func(queue *Queue, message *Message, file string, info os.FileInfo) {
+		for _, copy := range store.MessagePaths(queue, message)[1:] {
+			if os.Remove(copy) == nil {
+				recovery.Removed += 1
+			}
+		}
+	})
+
+	// A delayed message also found in its queue goes back to being only
+	// in its queue. One which is due, as the mover would have it, is
+	// re-delivered.
+	store.RecoverFolder(store.DelayFolder, recovery, func(queue *Queue, message *Message, file string, info os.FileInfo) {
+		delayPath := path.Join(store.DelayFolder, file)
+		queuePath := store.QueuePath(queue, message.Id)
+
+		if _, err := os.Stat(queuePath); err == nil {
+			if os.Remove(delayPath) == nil {
+				recovery.RolledBack += 1
+			}
+			return
+		}
+
+		if time.Now().After(spool.DueAt(info.ModTime(), store.Visibility)) && store.Deliver(delayPath, queue, message.Id) == nil {
+			recovery.Requeued += 1
+		}
+	})
+
+	// A new message already delivered elsewhere is a leftover copy.
+	// Anything else is delivered to its queue, empty or not, as a message
+	// only reaches the new folder once it is completely written.
+	store.RecoverFolder(store.NewFolder, recovery, func(queue *Queue, message *Message, file string, info os.FileInfo) {
+		newPath := path.Join(store.NewFolder, file)
+
+		for _, copy := range store.MessagePaths(queue, message)[:3] {
+			if _, err := os.Stat(copy); err == nil {
+				if os.Remove(newPath) == nil {
+					recovery.RolledBack += 1
+				}
+				return
+			}
+		}
+
+		if store.Deliver(newPath, queue, message.Id) == nil {
+			recovery.Delivered += 1
+		}
+	})
+
+	// A receive count is kept for as long as its message is anywhere short
+	// of being removed. One staged aside and never moved into place is
+	// dropped once it is as old as an abandoned staged message.
+	if infos, err := ioutil.ReadDir(store.ReceivesFolder); err == nil {
+		for _, info := range infos {
+			countPath := path.Join(store.ReceivesFolder, info.Name())
+			queue, message := ParseMessageFile(info.Name())
+
+			switch {
+			case strings.HasPrefix(info.Name(), "."):
+				if time.Since(info.ModTime()) > StagingLifetime {
+					os.Remove(countPath)
+				}
+			case queue == nil || !store.Exists(queue, message):
+				os.Remove(countPath)
+			}
+		}
+	}
+
+	log.Printf("Recovered %s: %d delivered, %d requeued, %d removed, %d rolled back, %d orphaned, %d invalid",
+		store.Root, recovery.Delivered, recovery.Requeued, recovery.Removed, recovery.RolledBack, recovery.Orphaned, recovery.Invalid)
+
+	return recovery
+}
+
+// Calls recover for every valid message file in a folder whose queue exists.
+// Files of queues which no longer exist are unlinked, and anything else is
+// quarantined in the invalid folder.
+func (store *Store) RecoverFolder(folder string, recovery *Recovery, recover func(*Queue, *Message, string, os.FileInfo)) {
+	infos, err := ioutil.ReadDir(folder)
+
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	for _, info := range infos {
+		file := info.Name()
+		queue, message := ParseMessageFile(file)
+
+		switch {
+		case queue == nil || !info.Mode().IsRegular():
+			store.Rename(path.Join(folder, file), path.Join(store.InvalidFolder, file))
+			recovery.Invalid += 1
+		case store.FetchQueue(context.Background(), queue) != nil:
+			os.Remove(path.Join(folder, file))
+			recovery.Orphaned += 1
+		default:
+			recover(queue, message, file, info)
+		}
+	}
+}
+
+// Whether a message is anywhere in its lifecycle but the remove folder.
+func (store *Store) Exists(queue *Queue, message *Message) bool {
+	for _, copy := range store.MessagePaths(queue, message)[1:] {
+		if _, err := os.Stat(copy); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/softlayer/mq/spool"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Where a message waits in its queue. Without sharding that is the queue's
+// folder, otherwise the bucket of its ID within it.
+func (store *Store) QueuePath(queue *Queue, messageId string) string {
+	return spool.QueuePath(store.QueuesFolder, queue.Id, messageId, store.Shard)
+}
+
+// The folders holding a queue's messages, oldest first. Without sharding that
+// is only the queue's folder itself.
+func (store *Store) Buckets(queue *Queue) ([]string, error) {
+	queuePath := path.Join(store.QueuesFolder, queue.Id)
+
+	if store.Shard <= 0 {
+		_, err := os.Stat(queuePath)
+		return []string{queuePath}, err
+	}
+
+	infos, err := ioutil.ReadDir(queuePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var buckets []string
+
+	for _, info := range infos {
+		if info.IsDir() && !strings.HasPrefix(info.Name(), ".") {
+			buckets = append(buckets, path.Join(queuePath, info.Name()))
+		}
+	}
+
+	sort.Strings(buckets)
+
+	return buckets, nil
+}
+
+// Removes a bucket left empty, unless it is the one new messages are going
+// into right now. Anything still in it keeps it in place, and watched.
+func (store *Store) RemoveBucket(bucketPath string) {
+	if store.Shard <= 0 || path.Base(bucketPath) == spool.BucketAt(time.Now(), store.Shard) {
+		return
+	}
+
+	store.Index.Unwatch(bucketPath)
+
+	if os.Remove(bucketPath) != nil {
+		store.Index.WatchBucket(&Queue{Id: path.Base(path.Dir(bucketPath))}, bucketPath)
+	}
+}
+
+// Moves a message into its queue, creating its bucket if needed. A bucket
+// removed at the same time as the message arrives is created again.
+func (store *Store) Deliver(source string, queue *Queue, messageId string) error {
+	err := spool.Deliver(source, store.QueuesFolder, queue.Id, messageId, store.Shard, store.Strict)
+
+	if err == nil {
+		store.Index.Add(queue, messageId)
+	}
+
+	return err
+}
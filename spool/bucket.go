@@ -0,0 +1,26 @@
+// Package spool holds what mq and its tools (mq-mover, mq-reaper and
+// mq-shard) need to agree on about the folders messages pass through.
+package spool
+
+import (
+	"fmt"
+	"time"
+)
+
+// The bucket a message belongs in when its queue is sharded by the given
+// interval: the creation time of its ID, truncated to the interval, in Unix
+// seconds. Buckets are zero-padded so they sort oldest first by name. IDs
+// which aren't time based all share the first bucket.
+func Bucket(messageId string, shard time.Duration) string {
+	return BucketAt(UUIDTime(messageId), shard)
+}
+
+func BucketAt(created time.Time, shard time.Duration) string {
+	seconds := int64(0)
+
+	if !created.IsZero() {
+		seconds = max(created.Truncate(shard).Unix(), 0)
+	}
+
+	return fmt.Sprintf("%012d", seconds)
+}
@@ -0,0 +1,91 @@
+package spool
+
+import (
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// The names mq allows for queues and messages.
+var (
+	QueueName   = regexp.MustCompile("^[a-z]+$")
+	MessageName = regexp.MustCompile("^[a-z0-9-]+$")
+)
+
+// Splits a message file name, queue:id, into its queue and message IDs.
+// Returns false for anything else.
+func ParseMessageFile(name string) (string, string, bool) {
+	pieces := strings.Split(name, ":")
+
+	if len(pieces) != 2 || !QueueName.MatchString(pieces[0]) || !MessageName.MatchString(pieces[1]) {
+		return "", "", false
+	}
+
+	return pieces[0], pieces[1], true
+}
+
+// Where a message waits in its queue, under the given queues folder. Without
+// sharding that is the queue's folder, otherwise the bucket of its ID within
+// it.
+func QueuePath(queues string, queueId string, messageId string, shard time.Duration) string {
+	if shard > 0 {
+		return path.Join(queues, queueId, Bucket(messageId, shard), messageId)
+	}
+
+	return path.Join(queues, queueId, messageId)
+}
+
+// Moves a message into its queue, creating its bucket if needed. A bucket
+// removed at the same time as the message arrives is created again.
+func Deliver(source string, queues string, queueId string, messageId string, shard time.Duration, strict bool) error {
+	destination := QueuePath(queues, queueId, messageId, shard)
+	err := Rename(source, destination, strict)
+
+	for attempt := 0; shard > 0 && os.IsNotExist(err) && attempt < 3; attempt++ {
+		if _, statErr := os.Stat(source); statErr != nil {
+			break
+		}
+
+		// A new bucket has to be flushed into its queue's folder as well.
+		if os.Mkdir(path.Dir(destination), 0777) == nil && strict {
+			SyncFolder(path.Dir(path.Dir(destination)))
+		}
+
+		err = Rename(source, destination, strict)
+	}
+
+	return err
+}
+
+// Moves a file. When strict, it then flushes the folder it moved into and the
+// one it left, in that order. A crash in between can leave the file in both,
+// but never in neither.
+func Rename(source string, destination string, strict bool) error {
+	err := os.Rename(source, destination)
+
+	if err != nil || !strict {
+		return err
+	}
+
+	if err = SyncFolder(path.Dir(destination)); err != nil {
+		return err
+	}
+
+	return SyncFolder(path.Dir(source))
+}
+
+// Flushes a folder, so the names created, moved or removed in it survive a
+// crash.
+func SyncFolder(folder string) error {
+	folderDir, err := os.Open(folder)
+
+	if err != nil {
+		return err
+	}
+
+	defer folderDir.Close()
+
+	return folderDir.Sync()
+}
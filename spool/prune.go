@@ -0,0 +1,44 @@
+package spool
+
+import (
+	"io/ioutil"
+	"log"
+	"path"
+	"sort"
+	"time"
+)
+
+// Calls unlink for retained messages in a folder, oldest removed first, until
+// none is older than retain and together they take up no more than
+// retainBytes. Either is ignored when not positive. mq stamps every message
+// with the time it was removed.
+func Prune(folder string, retain time.Duration, retainBytes int64, unlink func(file string)) {
+	infos, err := ioutil.ReadDir(folder)
+
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+
+	retained := int64(0)
+
+	for _, info := range infos {
+		retained += info.Size()
+	}
+
+	for _, info := range infos {
+		expired := retain > 0 && time.Since(info.ModTime()) > retain
+		excess := retainBytes > 0 && retained > retainBytes
+
+		if !expired && !excess {
+			break
+		}
+
+		unlink(path.Join(folder, info.Name()))
+		retained -= info.Size()
+	}
+}
@@ -1,7 +1,8 @@
-package main
+package spool
 
 import (
 	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
@@ -65,6 +66,28 @@ func TimeUUID() string {
 	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
 }
 
+// Recovers the creation time from an ID generated by TimeUUID. Anything not
+// shaped like a time based UUID yields the zero time.
+func UUIDTime(id string) time.Time {
+	var uuid [16]byte
+
+	if len(id) != 36 {
+		return time.Time{}
+	}
+
+	_, err := hex.Decode(uuid[:], []byte(id[0:8]+id[9:13]+id[14:18]+id[19:23]+id[24:36]))
+
+	if err != nil || uuid[6]>>4 != 1 {
+		return time.Time{}
+	}
+
+	t := uint64(uuid[6]&0x0F)<<56 | uint64(uuid[7])<<48 |
+		uint64(uuid[4])<<40 | uint64(uuid[5])<<32 |
+		uint64(uuid[0])<<24 | uint64(uuid[1])<<16 | uint64(uuid[2])<<8 | uint64(uuid[3])
+
+	return time.Unix(timeBase+int64(t/10000000), int64(t%10000000)*100).In(time.UTC)
+}
+
 func RandomUUID() string {
 	file, err := os.Open("/dev/urandom")
 
@@ -0,0 +1,289 @@
+package spool
+
+import (
+	"code.google.com/p/go.exp/inotify"
+	"container/heap"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Watches a folder for files moved into it, and hands each one over on Files
+// once it is due. This is the loop of mq-mover and mq-reaper, and of the
+// mover and reaper run within mq, until Quit is closed. A watch without Quit
+// runs for as long as its process does.
+//
+// Files already in the folder when watching starts are handed over too, and
+// the folder is swept again every Sweep, if set, for any an event was missed
+// for. It is also read again whenever inotify drops events, which is counted
+// in Overflows. A file is only ever held once at a time.
+//
+// Delayed files are held in a single schedule rather than a goroutine each,
+// so a folder of many leased messages costs a heap entry apiece.
+type Watch struct {
+	Delay     time.Duration
+	Sweep     time.Duration
+	Directory string
+	Files     chan string
+	Quit      chan struct{}
+	Pending   map[string]bool
+	Held      Schedule
+	Wake      chan struct{}
+	Overflows int
+	Lock      sync.Mutex
+}
+
+func (watch *Watch) Run() error {
+	notify, err := inotify.NewWatcher()
+
+	if err != nil {
+		return err
+	}
+
+	// Files are only ever moved into the folders we watch once complete,
+	// never written in place.
+	if err = notify.AddWatch(watch.Directory, inotify.IN_MOVED_TO); err != nil {
+		notify.Close()
+		return err
+	}
+
+	watch.Files = make(chan string)
+	watch.Pending = make(map[string]bool)
+	watch.Wake = make(chan struct{}, 1)
+
+	go watch.Release()
+
+	go func() {
+		var sweeps <-chan time.Time
+
+		if watch.Sweep > 0 {
+			ticker := time.NewTicker(watch.Sweep)
+			defer ticker.Stop()
+
+			sweeps = ticker.C
+		}
+
+		// Watching started before this, so nothing falls in between.
+		watch.Scan()
+
+		for {
+			select {
+			case ev := <-notify.Event:
+				watch.Handle(ev)
+			case err := <-notify.Error:
+				log.Print(err)
+			case <-sweeps:
+				watch.Scan()
+			case <-watch.Quit:
+				notify.Close()
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Hands over every file in the folder which isn't held already.
+func (watch *Watch) Scan() {
+	folder, err := os.Open(watch.Directory)
+
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	names, err := folder.Readdirnames(-1)
+	folder.Close()
+
+	if err != nil {
+		log.Print(err)
+	}
+
+	for _, name := range names {
+		if !strings.HasPrefix(name, ".") {
+			watch.Take(path.Join(watch.Directory, name))
+		}
+	}
+}
+
+func (watch *Watch) Handle(ev *inotify.Event) {
+	// Events were dropped, so any file could have arrived.
+	if ev.Mask&inotify.IN_Q_OVERFLOW != 0 {
+		watch.Lock.Lock()
+		watch.Overflows += 1
+		overflows := watch.Overflows
+		watch.Lock.Unlock()
+
+		log.Print("Rescanning ", watch.Directory, " after inotify overflow ", overflows)
+		watch.Scan()
+		return
+	}
+
+	watch.Take(ev.Name)
+}
+
+// Holds a file until it is due, unless it is held already. Without a delay,
+// that is right away.
+func (watch *Watch) Take(file string) {
+	watch.Lock.Lock()
+	pending := watch.Pending[file]
+	watch.Pending[file] = true
+	watch.Lock.Unlock()
+
+	if pending {
+		return
+	}
+
+	if watch.Delay <= 0 {
+		watch.Emit(file)
+		return
+	}
+
+	info, err := os.Stat(file)
+
+	if err != nil {
+		watch.Forget(file)
+		return
+	}
+
+	watch.Hold(file, info.ModTime())
+}
+
+// Schedules a file for when it is due, given its modification time.
+func (watch *Watch) Hold(file string, modified time.Time) {
+	watch.Lock.Lock()
+	heap.Push(&watch.Held, &Held{File: file, Due: watch.DueAt(modified), Modified: modified})
+	watch.Lock.Unlock()
+
+	select {
+	case watch.Wake <- struct{}{}:
+	default:
+	}
+}
+
+// When a file is due. A modification time in the future (stamped by a queue's
+// visibility timeout, or an extended lease) is when it is due, any other is
+// followed by the given delay. It only depends on the file, so the schedule is
+// rebuilt as it was by reading the folder after a restart, except that a lease
+// stamped by a visibility timeout which ran out in the meantime is then
+// followed by the delay as well. Recovery in mq decides the same way.
+func DueAt(modified time.Time, delay time.Duration) time.Time {
+	if modified.After(time.Now()) {
+		return modified
+	}
+
+	return modified.Add(delay)
+}
+
+func (watch *Watch) DueAt(modified time.Time) time.Time {
+	return DueAt(modified, watch.Delay)
+}
+
+// Hands over held files as they fall due, until Quit is closed.
+func (watch *Watch) Release() {
+	for {
+		var due <-chan time.Time
+
+		var timer *time.Timer
+
+		watch.Lock.Lock()
+
+		if watch.Held.Len() > 0 {
+			timer = time.NewTimer(time.Until(watch.Held[0].Due))
+			due = timer.C
+		}
+
+		watch.Lock.Unlock()
+
+		select {
+		case <-due:
+			watch.ReleaseDue()
+		case <-watch.Wake:
+		case <-watch.Quit:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		select {
+		case <-watch.Quit:
+			return
+		default:
+		}
+	}
+}
+
+// Hands over the file due first. One whose modification time changed while it
+// was held, as its lease was extended or it was fetched again, is held anew,
+// and one which is gone is dropped.
+func (watch *Watch) ReleaseDue() {
+	watch.Lock.Lock()
+	held := heap.Pop(&watch.Held).(*Held)
+	watch.Lock.Unlock()
+
+	info, err := os.Stat(held.File)
+
+	switch {
+	case err != nil:
+		watch.Forget(held.File)
+	case !info.ModTime().Equal(held.Modified):
+		watch.Hold(held.File, info.ModTime())
+	default:
+		watch.Emit(held.File)
+	}
+}
+
+func (watch *Watch) Emit(file string) {
+	select {
+	case watch.Files <- file:
+	case <-watch.Quit:
+	}
+
+	watch.Forget(file)
+}
+
+func (watch *Watch) Forget(file string) {
+	watch.Lock.Lock()
+	delete(watch.Pending, file)
+	watch.Lock.Unlock()
+}
+
+// A file held until it is due, and the modification time that was worked out
+// from.
+type Held struct {
+	File     string
+	Due      time.Time
+	Modified time.Time
+}
+
+// The files held by a watch, as a heap with the one due first on top.
+type Schedule []*Held
+
+func (schedule Schedule) Len() int {
+	return len(schedule)
+}
+
+func (schedule Schedule) Less(i, j int) bool {
+	return schedule[i].Due.Before(schedule[j].Due)
+}
+
+func (schedule Schedule) Swap(i, j int) {
+	schedule[i], schedule[j] = schedule[j], schedule[i]
+}
+
+func (schedule *Schedule) Push(held interface{}) {
+	*schedule = append(*schedule, held.(*Held))
+}
+
+func (schedule *Schedule) Pop() interface{} {
+	last := len(*schedule) - 1
+	held := (*schedule)[last]
+	*schedule = (*schedule)[:last]
+
+	return held
+}
@@ -0,0 +1,462 @@
+//go:build sqlite
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/softlayer/mq/spool"
+	"strconv"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const SqliteSchema = `
+CREATE TABLE IF NOT EXISTS queues (
+	id      TEXT PRIMARY KEY,
+	config  TEXT NOT NULL DEFAULT '{}'
+);
+
+CREATE TABLE IF NOT EXISTS messages (
+	queue    TEXT NOT NULL,
+	id       TEXT NOT NULL,
+	content  BLOB NOT NULL,
+	size     INTEGER NOT NULL,
+	created  INTEGER NOT NULL,
+	deadline INTEGER NOT NULL DEFAULT 0,
+	receives INTEGER NOT NULL DEFAULT 0,
+	UNIQUE (queue, id)
+);
+
+CREATE INDEX IF NOT EXISTS messages_ready ON messages (queue, deadline);
+`
+
+// A backend keeping every queue in a single SQLite database, for small
+// deployments which would rather not manage thousands of folders. A message
+// is a row, and its lease a deadline in Unix nanoseconds which is zero while
+// it waits to be fetched. Each operation is a transaction, and the database
+// is only ever used through one connection, so fetches never race each other.
+type SqliteStore struct {
+	Limits
+	Unretained
+
+	Peers      int
+	Visibility time.Duration
+	Database   *sql.DB
+}
+
+func NewSqliteStore(peers int, limits Limits, visibility time.Duration, file string) (*SqliteStore, error) {
+	database, err := sql.Open("sqlite", file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite has a single writer anyway, and a single connection keeps a
+	// transaction from waiting on another one of ours.
+	database.SetMaxOpenConns(1)
+
+	for _, statement := range []string{"PRAGMA journal_mode = WAL", "PRAGMA synchronous = FULL", SqliteSchema} {
+		if _, err = database.Exec(statement); err != nil {
+			database.Close()
+			return nil, err
+		}
+	}
+
+	store := &SqliteStore{}
+	store.Peers = peers
+	store.Limits = limits
+	store.Visibility = visibility
+	store.Database = database
+
+	return store, nil
+}
+
+// Runs a function in a transaction, committing it unless the function fails.
+// The transaction is rolled back if the context is done before it commits.
+func (store *SqliteStore) Transaction(ctx context.Context, function func(tx *sql.Tx) error) error {
+	tx, err := store.Database.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	err = function(tx)
+
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func QueueConfigFrom(tx *sql.Tx, queueId string) (*QueueConfig, error) {
+	var content string
+	err := tx.QueryRow("SELECT config FROM queues WHERE id = ?", queueId).Scan(&content)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrQueueNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	config := &QueueConfig{}
+	json.Unmarshal([]byte(content), config)
+
+	return config, nil
+}
+
+func (store *SqliteStore) SaveQueue(ctx context.Context, queue *Queue) error {
+	return store.Transaction(ctx, func(tx *sql.Tx) error {
+		_, err := tx.Exec("INSERT OR IGNORE INTO queues (id) VALUES (?)", queue.Id)
+
+		// Without attributes, whatever the queue had before is kept.
+		if err != nil || queue.Config == nil {
+			return err
+		}
+
+		content, err := json.Marshal(queue.Config)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE queues SET config = ? WHERE id = ?", string(content), queue.Id)
+
+		return err
+	})
+}
+
+func (store *SqliteStore) FetchQueue(ctx context.Context, queue *Queue) error {
+	return store.Transaction(ctx, func(tx *sql.Tx) error {
+		config, err := QueueConfigFrom(tx, queue.Id)
+
+		if err == nil {
+			queue.Config = config
+		}
+
+		return err
+	})
+}
+
+func (store *SqliteStore) DeleteQueue(ctx context.Context, queue *Queue) error {
+	return store.Transaction(ctx, func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM messages WHERE queue = ?", queue.Id)
+
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM queues WHERE id = ?", queue.Id)
+		}
+
+		return err
+	})
+}
+
+func (store *SqliteStore) SaveMessage(ctx context.Context, queue *Queue, message *Message) error {
+	queueCopy := &Queue{Id: queue.Id}
+
+	if err := store.FetchQueue(ctx, queueCopy); err != nil {
+		return err
+	}
+
+	config := queueCopy.Config
+
+	// The content is read whole before the transaction starts, so a slow
+	// client never holds the database.
+	content, err := store.ReadContent(ctx, config, message)
+
+	if err != nil {
+		return err
+	}
+
+	created := int64(0)
+
+	if spool.UUIDTime(message.Id) != (time.Time{}) {
+		created = spool.UUIDTime(message.Id).UnixNano()
+	}
+
+	return store.Transaction(ctx, func(tx *sql.Tx) error {
+		// The queue may have gone while we were reading.
+		if _, err := QueueConfigFrom(tx, queue.Id); err != nil {
+			return err
+		}
+
+		usage := &QueueUsage{}
+		err := tx.QueryRow("SELECT count(*), coalesce(sum(size), 0) FROM messages WHERE queue = ? AND deadline <= ?", queue.Id, time.Now().UnixNano()).Scan(&usage.Messages, &usage.Bytes)
+
+		if err != nil {
+			return err
+		}
+
+		if err = store.Check(config, usage, int64(len(content))); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO messages (queue, id, content, size, created) VALUES (?, ?, ?, ?, ?)",
+			queue.Id, message.Id, content, len(content), created)
+
+		if err != nil {
+			return ErrNotSaved
+		}
+
+		return nil
+	})
+}
+
+func (store *SqliteStore) FetchMessage(ctx context.Context, queue *Queue) (*Message, error) {
+	var message *Message
+
+	err := store.Transaction(ctx, func(tx *sql.Tx) error {
+		config, err := QueueConfigFrom(tx, queue.Id)
+
+		if err == ErrQueueNotFound {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+
+		for {
+			rows, err := tx.Query("SELECT rowid, id, created, receives FROM messages WHERE queue = ? AND deadline <= ? ORDER BY created, rowid LIMIT ?", queue.Id, now.UnixNano(), store.Peers+1)
+
+			if err != nil {
+				return err
+			}
+
+			var rowids, createds []int64
+			var ids []string
+			var receives []int
+
+			for rows.Next() {
+				var rowid, created int64
+				var id string
+				var received int
+
+				if err = rows.Scan(&rowid, &id, &created, &received); err != nil {
+					rows.Close()
+					return err
+				}
+
+				rowids = append(rowids, rowid)
+				ids = append(ids, id)
+				createds = append(createds, created)
+				receives = append(receives, received)
+			}
+
+			rows.Close()
+
+			if len(rowids) == 0 {
+				return nil
+			}
+
+			i := PickReady(store.Peers, len(rowids), config.Fifo)
+			rowid := rowids[i]
+
+			if config.Expired(time.Unix(0, createds[i]), now) {
+				if _, err = tx.Exec("DELETE FROM messages WHERE rowid = ?", rowid); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			if config.Exhausted(receives[i]) {
+				if _, err = QueueConfigFrom(tx, config.DeadLetterQueue); err == nil {
+					_, err = tx.Exec("UPDATE messages SET queue = ?, deadline = 0, receives = 0 WHERE rowid = ?", config.DeadLetterQueue, rowid)
+				} else if err == ErrQueueNotFound {
+					_, err = tx.Exec("DELETE FROM messages WHERE rowid = ?", rowid)
+				}
+
+				if err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			deadline := config.LeaseDeadline(store.Visibility, now)
+
+			var content []byte
+
+			_, err = tx.Exec("UPDATE messages SET deadline = ?, receives = receives + 1 WHERE rowid = ?", deadline.UnixNano(), rowid)
+
+			if err == nil {
+				err = tx.QueryRow("SELECT content FROM messages WHERE rowid = ?", rowid).Scan(&content)
+			}
+
+			if err != nil {
+				return err
+			}
+
+			message = SqliteMessage(ids[i], content)
+			message.Receipt = Receipt(deadline)
+
+			return nil
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// Messages here are small enough to be read whole, and handed out the same
+// way the memory backend does.
+func SqliteMessage(id string, content []byte) *Message {
+	return &Message{
+		Id:   id,
+		Size: int64(len(content)),
+		Body: MemoryBody{bytes.NewReader(content)},
+	}
+}
+
+func (store *SqliteStore) ReleaseMessage(ctx context.Context, queue *Queue, message *Message) error {
+	return store.Transaction(ctx, func(tx *sql.Tx) error {
+		return store.Lease(tx, queue, message, time.Time{})
+	})
+}
+
+func (store *SqliteStore) ExtendMessage(ctx context.Context, queue *Queue, message *Message, visibility time.Duration) error {
+	deadline := time.Now().Add(visibility)
+
+	err := store.Transaction(ctx, func(tx *sql.Tx) error {
+		return store.Lease(tx, queue, message, deadline)
+	})
+
+	if err == nil {
+		message.Receipt = Receipt(deadline)
+	}
+
+	return err
+}
+
+// Replaces the lease of a message, as long as its receipt is of the current
+// one. A zero deadline makes the message ready right away.
+func (store *SqliteStore) Lease(tx *sql.Tx, queue *Queue, message *Message, deadline time.Time) error {
+	nanos := int64(0)
+
+	if !deadline.IsZero() {
+		nanos = deadline.UnixNano()
+	}
+
+	leased, err := strconv.ParseInt(message.Receipt, 10, 64)
+
+	if err != nil {
+		return ErrLeaseLost
+	}
+
+	result, err := tx.Exec("UPDATE messages SET deadline = ? WHERE queue = ? AND id = ? AND deadline > 0 AND deadline = ?", nanos, queue.Id, message.Id, leased)
+
+	if err != nil {
+		return err
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrLeaseLost
+	}
+
+	return nil
+}
+
+func (store *SqliteStore) DeleteMessage(ctx context.Context, queue *Queue, message *Message) error {
+	return store.Transaction(ctx, func(tx *sql.Tx) error {
+		var deadline int64
+		err := tx.QueryRow("SELECT deadline FROM messages WHERE queue = ? AND id = ?", queue.Id, message.Id).Scan(&deadline)
+
+		if err == sql.ErrNoRows && message.Receipt == "" {
+			return ErrMessageNotFound
+		}
+
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+
+		// A leased message is only deleted with the receipt of its lease,
+		// or without one once the lease ran out.
+		if err == sql.ErrNoRows || message.Receipt != "" && message.Receipt != Receipt(time.Unix(0, deadline)) || message.Receipt == "" && deadline > time.Now().UnixNano() {
+			return ErrLeaseLost
+		}
+
+		_, err = tx.Exec("DELETE FROM messages WHERE queue = ? AND id = ?", queue.Id, message.Id)
+
+		return err
+	})
+}
+
+func (store *SqliteStore) ListMessages(ctx context.Context, queue *Queue) ([]string, error) {
+	var messageIds []string
+
+	err := store.Transaction(ctx, func(tx *sql.Tx) error {
+		if _, err := QueueConfigFrom(tx, queue.Id); err != nil {
+			return err
+		}
+
+		rows, err := tx.Query("SELECT id FROM messages WHERE queue = ? AND deadline <= ? ORDER BY rowid", queue.Id, time.Now().UnixNano())
+
+		if err != nil {
+			return err
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			var id string
+
+			if err = rows.Scan(&id); err != nil {
+				return err
+			}
+
+			messageIds = append(messageIds, id)
+		}
+
+		return rows.Err()
+	})
+
+	return messageIds, err
+}
+
+func (store *SqliteStore) StatMessage(ctx context.Context, queue *Queue, message *Message) (*Message, error) {
+	var size int64
+	err := store.Database.QueryRowContext(ctx, "SELECT size FROM messages WHERE queue = ? AND id = ?", queue.Id, message.Id).Scan(&size)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{Id: message.Id, Size: size}, nil
+}
+
+func (store *SqliteStore) OpenMessage(ctx context.Context, queue *Queue, message *Message) (*Message, error) {
+	var content []byte
+	err := store.Database.QueryRowContext(ctx, "SELECT content FROM messages WHERE queue = ? AND id = ?", queue.Id, message.Id).Scan(&content)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return SqliteMessage(message.Id, content), nil
+}
+
+// Every transaction is committed before it returns, so there is nothing to
+// wait for.
+func (store *SqliteStore) Close(ctx context.Context) bool {
+	return store.Database.Close() == nil
+}
@@ -0,0 +1,65 @@
+//go:build sqlite
+
+package main
+
+import (
+	"context"
+	"github.com/softlayer/mq/spool"
+	"path"
+	"testing"
+	"time"
+)
+
+func init() {
+	testBackends = append(testBackends, testBackend{"sqlite", func(t *testing.T, peers int, limits Limits) Backend {
+		store, err := NewSqliteStore(peers, limits, time.Minute, path.Join(t.TempDir(), "mq.db"))
+
+		if err != nil {
+			t.Fatal("Could not open database:", err)
+		}
+
+		t.Cleanup(func() { store.Close(context.Background()) })
+
+		return store
+	}})
+}
+
+func TestSqliteBackend(t *testing.T) {
+	ctx := context.Background()
+
+	// Configured as the flags would configure it.
+	defer func(previousRoot string, previousVisibility time.Duration, previousSize int64) {
+		root, visibility, maxMessageSize = previousRoot, previousVisibility, previousSize
+	}(root, visibility, maxMessageSize)
+
+	root = SqliteScheme + path.Join(t.TempDir(), "mq.db")
+	visibility = time.Minute
+	maxMessageSize = int64(len(messageContent))
+
+	store := NewBackend()
+	defer store.Close(ctx)
+
+	queue := &Queue{Id: queueId}
+	store.SaveQueue(ctx, queue)
+
+	if store.SaveMessage(ctx, queue, newMessage(spool.TimeUUID(), append(messageContent, '!'))) != ErrMessageTooLarge {
+		t.Error("Saved a message larger than the server allows")
+	}
+
+	if store.SaveMessage(ctx, queue, newMessage(messageId, messageContent)) != nil {
+		t.Fatal("Could not save message")
+	}
+
+	fetched, _ := store.FetchMessage(ctx, queue)
+
+	if fetched == nil {
+		t.Fatal("Could not fetch message")
+	}
+
+	fetched.Body.Close()
+
+	// The lease lasts as long as the server's visibility.
+	if again, _ := store.FetchMessage(ctx, queue); again != nil {
+		t.Error("Fetched a leased message again")
+	}
+}
@@ -1,49 +1,150 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/softlayer/mq/spool"
 	"hash/crc32"
+	"io"
 	"io/ioutil"
+	"log"
 	"math/rand"
 	"os"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-type Queue struct {
-	Id string
-}
-
-type Message struct {
-	Id      string
-	Content []byte
-}
-
+// Requests handed to the workers. Whoever made one stops waiting for its
+// response once its Context is done, and the worker skips it if that happens
+// before it is taken up.
 type SaveRequest struct {
+	Context  context.Context
 	Queue    *Queue
 	Message  *Message
-	Response chan bool
+	Limit    int64
+	Response chan error
 }
 
+// A fetch request claims a message, unless it has Lease set: then it changes
+// the lease of one the queue's messages instead, answered on Result. Either
+// goes to the queue's fetch worker, so a receipt checked is still current
+// when it is acted on, as far as this daemon goes.
 type FetchRequest struct {
+	Context  context.Context
 	Queue    *Queue
+	Config   *QueueConfig
 	Response chan *Message
+	Lease    func() error
+	Result   chan error
 }
 
+// The file system backend. Each queue is a folder, each message a file, and
+// every step of a message's lifecycle a rename between folders.
 type Store struct {
 	Race      int
 	Duplicate int
 
+	// What the embedded mover and reaper did, if they run: messages
+	// delivered from the new folder, re-delivered from the delay folder,
+	// and unlinked from the remove folder, files quarantined for not being
+	// named queue:id, files gone before they could be handled, and files
+	// which couldn't be.
+	Delivered   int
+	Requeued    int
+	Reaped      int
+	Quarantined int
+	Vanished    int
+	Failed      int
+	MovesLock   sync.Mutex
+
+	// How often the embedded mover and reaper sweep their folders for
+	// files they missed, if at all, and the watches of those folders.
+	Sweep   time.Duration
+	Watches []*spool.Watch
+
+	// How often what they did is logged while they run, if at all.
+	Report time.Duration
+
+	// How long, and up to how many bytes, the embedded reaper keeps
+	// removed messages for, so they can be replayed. Without either, they
+	// are unlinked right away. Otherwise the oldest beyond either are
+	// unlinked every Prune.
+	Retain      time.Duration
+	RetainBytes int64
+	Prune       time.Duration
+
 	Workers       int
 	Peers         int
 	Root          string
+	StagingFolder string
 	NewFolder     string
 	DelayFolder   string
 	QueuesFolder  string
 	RemoveFolder  string
+	InvalidFolder string
 	SaveRequests  []chan *SaveRequest
 	FetchRequests []chan *FetchRequest
+
+	// How many requests may wait for each worker, and how long a request
+	// may take from being queued to being answered. Beyond either, ErrBusy
+	// is returned rather than waiting on a slow disk.
+	Backlog       int
+	WorkerTimeout time.Duration
+
+	// How long a fetched message stays in the delay folder, unless its queue
+	// says otherwise. This is the delay of the mover re-delivering them.
+	Visibility time.Duration
+
+	// The interval queues are bucketed by, if they are sharded. This must
+	// match the mover delivering to them.
+	Shard time.Duration
+
+	// Whether folders are flushed after every file created in or moved
+	// between them, so a saved message survives a power loss. Without it,
+	// only the content of new messages is flushed.
+	Strict bool
+
+	Limits
+
+	// Where how many times each message has been fetched is kept, along
+	// with the generation of its current lease, a file per message named
+	// like it.
+	ReceivesFolder string
+
+	// The last known usage of each queue with a capacity limit.
+	Usage     map[string]*QueueUsage
+	UsageLock sync.Mutex
+
+	// Paths of the messages being written right now, and whether they are
+	// still wanted. Those abandoned when we have to stop before they are
+	// complete are removed by their workers rather than handed over.
+	Writing     map[string]bool
+	WritingLock sync.Mutex
+
+	// Closed to stop the workers, which are counted by Working.
+	Quit    chan struct{}
+	Working sync.WaitGroup
+
+	// The messages ready in each queue, if they are indexed rather than
+	// read from the queue's folder on every fetch.
+	Index *ReadyIndex
+
+	// Where the queues choosing "log" storage keep their messages.
+	LogFolder string
+	Log       *LogStore
 }
 
+// How many requests may wait for each worker unless told otherwise.
+const DefaultBacklog = 64
+
+// How often retained messages are pruned unless told otherwise.
+const DefaultPrune = time.Minute
+
 func Checksum(id string) int {
 	return int(crc32.ChecksumIEEE([]byte(id)))
 }
@@ -53,21 +154,47 @@ func NewStore(workers int, peers int, root string) *Store {
 	store.Workers = workers
 	store.Peers = peers
 	store.Root = root
+	store.Backlog = DefaultBacklog
+	store.Prune = DefaultPrune
+	store.Usage = make(map[string]*QueueUsage)
+	store.Writing = make(map[string]bool)
+	store.Quit = make(chan struct{})
 
 	return store
 }
 
 func (store *Store) PrepareFolders() {
+	store.StagingFolder = path.Join(store.Root, "tmp")
 	store.NewFolder = path.Join(store.Root, "new")
 	store.DelayFolder = path.Join(store.Root, "delay")
 	store.QueuesFolder = path.Join(store.Root, "queues")
 	store.RemoveFolder = path.Join(store.Root, "remove")
+	store.InvalidFolder = path.Join(store.Root, "invalid")
+	store.ReceivesFolder = path.Join(store.Root, "receives")
+	store.LogFolder = path.Join(store.Root, "log")
 
 	os.Mkdir(store.Root, 0777)
+	os.Mkdir(store.StagingFolder, 0777)
 	os.Mkdir(store.NewFolder, 0777)
 	os.Mkdir(store.DelayFolder, 0777)
 	os.Mkdir(store.QueuesFolder, 0777)
 	os.Mkdir(store.RemoveFolder, 0777)
+	os.Mkdir(store.InvalidFolder, 0777)
+	os.Mkdir(store.ReceivesFolder, 0777)
+
+	store.Log = NewLogStore(store.Peers, store.LogFolder)
+	store.Log.Limits = store.Limits
+	store.Log.Visibility = store.Visibility
+	store.Log.Owner = store
+}
+
+// The log backend, if the queue keeps its messages there instead of in files.
+func (store *Store) LogOf(queue *Queue) *LogStore {
+	if store.FetchConfig(queue).Storage == "log" {
+		return store.Log
+	}
+
+	return nil
 }
 
 func (store *Store) PrepareWorkers() {
@@ -75,69 +202,403 @@ func (store *Store) PrepareWorkers() {
 	store.FetchRequests = make([]chan *FetchRequest, store.Workers)
 
 	for i := 0; i < store.Workers; i++ {
-		store.SaveRequests[i] = make(chan *SaveRequest)
-		store.FetchRequests[i] = make(chan *FetchRequest)
+		store.SaveRequests[i] = make(chan *SaveRequest, store.Backlog)
+		store.FetchRequests[i] = make(chan *FetchRequest, store.Backlog)
+
+		store.Working.Add(2)
 
 		go store.MessageSaver(i)
 		go store.MessageFetcher(i)
 	}
 }
 
-func (store *Store) SaveRequestToFile(request *SaveRequest) bool {
+// Stops the workers once they are done with the request at hand. If that
+// takes longer than the context allows, the messages still being written are
+// abandoned and false is returned. Each is removed by the worker writing it,
+// which owns the file until then.
+func (store *Store) Close(ctx context.Context) bool {
+	close(store.Quit)
+
+	done := make(chan struct{})
+
+	go func() {
+		store.Working.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		store.LogMoves()
+		return store.Log.Close(ctx)
+	case <-ctx.Done():
+		store.Log.Close(ctx)
+		store.WritingLock.Lock()
+		defer store.WritingLock.Unlock()
+
+		for messagePath := range store.Writing {
+			store.Writing[messagePath] = false
+		}
+
+		return false
+	}
+}
+
+// Writes a message to the staging folder, and only once it is complete and
+// flushed moves it to the new folder. The mover never sees a partial message.
+func (store *Store) SaveRequestToFile(request *SaveRequest) error {
 	messageFile := request.Queue.Id + ":" + request.Message.Id
-	messagePath := path.Join(store.NewFolder, messageFile)
+	messagePath := path.Join(store.StagingFolder, messageFile)
+
+	store.WritingLock.Lock()
+	store.Writing[messagePath] = true
+	store.WritingLock.Unlock()
 
 	file, err := os.OpenFile(messagePath, os.O_RDWR|os.O_CREATE, 0777)
 
 	// If we weren't able to open the file for writing,
 	// exit early. No need to close it.
 	if err != nil {
-		return false
+		store.Written(messagePath)
+		return ErrNotSaved
 	}
 
 	defer file.Close()
 
-	n, err := file.Write(request.Message.Content)
+	// Reading stops once the request is given up on, so the partial file is
+	// removed below rather than completed for nobody.
+	var body io.Reader = &ContextReader{Context: request.Context, Reader: request.Message.Body}
+
+	if request.Limit > 0 {
+		body = &SizeLimiter{Reader: body, Remaining: request.Limit}
+	}
+
+	// The body goes straight from the request to the file, so memory use
+	// doesn't depend on the size of the message.
+	written, err := io.Copy(file, body)
+
+	if err == nil {
+		err = request.Context.Err()
+	}
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	// A message abandoned while we were still writing it, because we had
+	// to stop, was not saved no matter how the write went.
+	if !store.Written(messagePath) {
+		os.Remove(messagePath)
+		return ErrNotSaved
+	}
 
-	// Could we write the entire message? If we couldn't, we
-	// need to clean up and report back.
-	if n < len(request.Message.Content) {
+	if err == nil {
+		err = store.HandOver(messagePath, path.Join(store.NewFolder, messageFile))
+	}
+
+	// Could we write, flush and hand over the entire message? If we
+	// couldn't, we need to clean up and report back.
+	if err != nil {
 		// Nuke the file...
 		os.Remove(messagePath)
 
 		// ...and return a negative response.
-		return false
+		if err == ErrMessageTooLarge {
+			return err
+		}
+
+		return ErrNotSaved
 	}
 
-	// If we couldn't write at all, break out. The defer will
-	// close the handle.
+	request.Message.Size = written
+
+	return nil
+}
+
+// Moves a written message into the new folder. If the folders cannot be
+// flushed afterwards, the message is taken back out of the new folder, so it
+// isn't delivered after all. One the mover already took along, or which
+// cannot be taken back, was handed over regardless, and counts as saved
+// rather than be saved twice by a retry.
+func (store *Store) HandOver(messagePath string, newPath string) error {
+	err := os.Rename(messagePath, newPath)
+
 	if err != nil {
-		return false
+		return err
+	}
+
+	if err = store.SyncFolder(path.Dir(newPath)); err == nil {
+		err = store.SyncFolder(path.Dir(messagePath))
+	}
+
+	if err != nil && os.Remove(newPath) != nil {
+		return nil
+	}
+
+	return err
+}
+
+// Marks a message as no longer being written. Returns false if it was
+// abandoned in the meantime. Once it returns true, the message is ours to hand
+// over, as Close no longer sees it.
+func (store *Store) Written(messagePath string) bool {
+	store.WritingLock.Lock()
+	defer store.WritingLock.Unlock()
+
+	writing := store.Writing[messagePath]
+	delete(store.Writing, messagePath)
+
+	return writing
+}
+
+// Flushes a folder, so the names created, moved or removed in it survive a
+// crash. Does nothing unless durability is strict.
+func (store *Store) SyncFolder(folder string) error {
+	if !store.Strict {
+		return nil
+	}
+
+	return spool.SyncFolder(folder)
+}
+
+// Moves a message to the remove folder, stamped with the time it was removed,
+// and forgets how many times it was received.
+// The reaper keeps it by that time when retaining removed messages. It is
+// stamped before the move, so the reaper never finds it with the time it was
+// left in its queue or leased until.
+func (store *Store) Discard(source string, file string) error {
+	now := time.Now()
+	os.Chtimes(source, now, now)
+
+	err := store.Rename(source, path.Join(store.RemoveFolder, file))
+
+	if err == nil {
+		store.Forget(file)
 	}
 
-	file.Sync()
+	return err
+}
+
+// Moves a file, then flushes the folder it moved into and the one it left, in
+// that order. A crash in between can leave the file in both, but never in
+// neither.
+func (store *Store) Rename(source string, destination string) error {
+	return spool.Rename(source, destination, store.Strict)
+}
+
+// Reads up to count message IDs from an open queue folder, skipping dot-files.
+// A negative count reads every message ID.
+func ReadMessageIds(queueDir *os.File, count int) []string {
+	var messageIds []string
+
+	for count < 0 || len(messageIds) < count {
+		names, err := queueDir.Readdirnames(count)
 
-	return true
+		for _, name := range names {
+			if !strings.HasPrefix(name, ".") {
+				messageIds = append(messageIds, name)
+			}
+		}
+
+		if err != nil || count < 0 {
+			break
+		}
+	}
+
+	return messageIds
 }
 
 func (store *Store) FetchRequestFromFile(request *FetchRequest) *Message {
-	queuePath := path.Join(store.QueuesFolder, request.Queue.Id)
-	queueDir, err := os.Open(queuePath)
+	// Every retry is another claim, not worth making for somebody who
+	// stopped waiting.
+	for request.Context.Err() == nil {
+		message, retry := store.FetchMessageFromFile(request.Queue, request.Config)
+
+		if !retry {
+			return message
+		}
+	}
+
+	return nil
+}
+
+// Attempts to fetch a single message. When the chosen message was discarded
+// instead of being delivered, retry is true and the caller should try again.
+func (store *Store) FetchMessageFromFile(queue *Queue, config *QueueConfig) (message *Message, retry bool) {
+	var messageId, bucketPath string
+
+	if store.Index != nil {
+		// The index knows what is ready without reading any folder.
+		messageId = store.Index.Pick(queue, config)
+		bucketPath = path.Dir(store.QueuePath(queue, messageId))
+	} else {
+		buckets, err := store.Buckets(queue)
 
+		if err != nil {
+			return nil, false
+		}
+
+		// Buckets are tried oldest first, and left behind once they are
+		// empty.
+		for _, bucketPath = range buckets {
+			if messageId = store.PickMessageId(bucketPath, config); messageId != "" {
+				break
+			}
+
+			store.RemoveBucket(bucketPath)
+		}
+	}
+
+	if messageId == "" {
+		return nil, false
+	}
+
+	file := queue.Id + ":" + messageId
+	messagePath := path.Join(bucketPath, messageId)
+
+	if config.Expired(spool.UUIDTime(messageId), time.Now()) {
+		store.Discard(messagePath, file)
+		store.Index.Remove(queue, messageId)
+		return nil, true
+	}
+
+	// The modification time of a delayed message is the moment it becomes
+	// eligible for re-delivery. Without a visibility timeout of its own,
+	// that is left up to the mover's delay. It is stamped before the move,
+	// so the mover never finds the message delayed with the time it was
+	// left in its queue.
+	deadline := time.Now().Add(time.Duration(config.VisibilityTimeout) * time.Second)
+	os.Chtimes(messagePath, deadline, deadline)
+
+	// A message is claimed by moving it to the delay folder. Only one fetch
+	// can win that move, so only the winner ever hands the message out.
+	delayPath := path.Join(store.DelayFolder, file)
+	err := store.Rename(messagePath, delayPath)
+	store.Index.Remove(queue, messageId)
+
+	// Even after attempting to randomize and slow down, we've lost the
+	// race for this message. When it came from the index, the index was
+	// behind, and another message can be tried.
 	if err != nil {
-		return nil
+		store.Race += 1
+		return nil, store.Index != nil
+	}
+
+	// The winner counts a receive, and starts a new generation of the
+	// lease. One which can't be recorded is left to run out.
+	receives, generation, err := store.Renew(file, true)
+
+	if err != nil {
+		log.Print("Could not lease ", file, ": ", err)
+		return nil, false
+	}
+
+	if config.Exhausted(receives - 1) {
+		if err = store.DeadLetter(delayPath, file, messageId, config.DeadLetterQueue); err != nil {
+			log.Print("Could not set aside ", file, " after ", config.MaxReceiveCount, " receives")
+		}
+
+		store.Forget(file)
+		return nil, true
+	}
+
+	messageFile, err := os.Open(delayPath)
+
+	if err != nil {
+		store.Duplicate += 1
+		return nil, true
+	}
+
+	info, err := messageFile.Stat()
+
+	// The lease may have run out and the message been claimed again in
+	// between, on a very short delay. Then it is no longer ours to hand out.
+	if _, current := store.Receives(file); err != nil || current != generation {
+		messageFile.Close()
+		store.Duplicate += 1
+		return nil, true
+	}
+
+	// The open file is handed over as it is, to be streamed and closed by
+	// whoever asked for the message.
+	message = &Message{
+		Id:      messageId,
+		Size:    info.Size(),
+		Body:    messageFile,
+		Receipt: strconv.FormatInt(generation, 10),
+	}
+
+	return message, false
+}
+
+// Sets aside a delayed message: to the dead letter queue, which may keep its
+// messages in a log rather than in files, or to the remove folder if there is
+// none. Into a log, it is copied before it is removed, so a crash in between
+// leaves a copy in both, never in none.
+func (store *Store) DeadLetter(delayPath string, file string, messageId string, deadLetterQueueId string) error {
+	deadLetterQueue := &Queue{Id: deadLetterQueueId}
+
+	if deadLetterQueueId == "" || store.FetchQueue(context.Background(), deadLetterQueue) != nil {
+		return store.Discard(delayPath, file)
+	}
+
+	log := store.LogOf(deadLetterQueue)
+
+	if log == nil {
+		return store.Deliver(delayPath, deadLetterQueue, messageId)
+	}
+
+	messageFile, err := os.Open(delayPath)
+
+	if err != nil {
+		return err
+	}
+
+	defer messageFile.Close()
+
+	err = log.SaveMessage(context.Background(), deadLetterQueue, &Message{Id: messageId, Size: -1, Body: messageFile})
+
+	if err == nil {
+		err = os.Remove(delayPath)
+	}
+
+	return err
+}
+
+// Chooses the next message to fetch from a folder of messages, or nothing if
+// it is empty.
+func (store *Store) PickMessageId(folder string, config *QueueConfig) string {
+	queueDir, err := os.Open(folder)
+
+	if err != nil {
+		return ""
 	}
 
 	defer queueDir.Close()
 
+	if config.Fifo {
+		// Strict ordering needs to see every message, and cannot afford the
+		// fuzziness we use to keep peers apart.
+		messageIds := ReadMessageIds(queueDir, -1)
+
+		if len(messageIds) == 0 {
+			return ""
+		}
+
+		sort.Slice(messageIds, func(i, j int) bool {
+			return spool.UUIDTime(messageIds[i]).Before(spool.UUIDTime(messageIds[j]))
+		})
+
+		return messageIds[0]
+	}
+
 	// We need to pull back at least peers+1 files so we can randomly
 	// select from a list of available message IDs near the beginning
 	// of this queue.
-	messageIds, err := queueDir.Readdirnames(store.Peers + 1)
+	messageIds := ReadMessageIds(queueDir, store.Peers+1)
 	messageCount := len(messageIds)
 
-	if err != nil || messageCount == 0 {
-		return nil
+	if messageCount == 0 {
+		return ""
 	}
 
 	// In the case we didn't get back enough to make an immediate
@@ -148,124 +609,640 @@ func (store *Store) FetchRequestFromFile(request *FetchRequest) *Message {
 
 	// Finally, pull a random message ID out of our list. In the case
 	// of peers = 0, this will simply pull the first message.
-	messageId := messageIds[rand.Intn(messageCount)]
-	messagePath := path.Join(queuePath, messageId)
+	return messageIds[rand.Intn(messageCount)]
+}
 
-	messageFile, err := os.Open(messagePath)
+// The receipt of a lease in the backends which keep its deadline: when it
+// runs out, in Unix nanoseconds. The file system's receipts are the
+// generations of its leases instead.
+func Receipt(deadline time.Time) string {
+	return strconv.FormatInt(deadline.UnixNano(), 10)
+}
 
-	// Even after attempting to randomize and slow down, we've lost
-	// the race to open this file.
-	if err != nil {
-		store.Race += 1
-		return nil
+// Reads how many times a message file has been delivered, and the generation
+// of its current lease. Both are kept on disk, so they survive a restart and
+// are shared by every peer.
+func (store *Store) Receives(file string) (int, int64) {
+	content, _ := ioutil.ReadFile(path.Join(store.ReceivesFolder, file))
+	fields := strings.Fields(string(content))
+	receives, generation := 0, int64(0)
+
+	if len(fields) > 0 {
+		receives, _ = strconv.Atoi(fields[0])
 	}
 
-	defer messageFile.Close()
+	if len(fields) > 1 {
+		generation, _ = strconv.ParseInt(fields[1], 10, 64)
+	}
 
-	// We can rename an open file handle. This protects us against
-	// rampant duplication. We will still be able to read from it.
-	err = os.Rename(messagePath, path.Join(store.DelayFolder, request.Queue.Id+":"+messageId))
+	return receives, generation
+}
 
-	// We have an open file handle, but couldn't rename it. Sombody
-	// else did. This is fine and we still return our message, but
-	// we need to record the duplication to further improve ourselves
-	// on the next attempt.
-	if err != nil {
-		store.Duplicate += 1
-	}
+// Starts a new generation of the lease of a message file, counting a delivery
+// along with it if it was claimed rather than extended. Generations are taken
+// from the clock, and only ever grow, so none is reused even once the message
+// is replayed after its count was forgotten. The file is written aside and
+// moved into place, so it is never read partially written.
+func (store *Store) Renew(file string, received bool) (int, int64, error) {
+	receives, generation := store.Receives(file)
 
-	messageContent, err := ioutil.ReadAll(messageFile)
+	if received {
+		receives += 1
+	}
 
-	if err != nil {
-		return nil
+	if now := time.Now().UnixNano(); now > generation {
+		generation = now
+	} else {
+		generation += 1
 	}
 
-	message := &Message{
-		Id:      messageId,
-		Content: messageContent,
+	countPath := path.Join(store.ReceivesFolder, file)
+	stagedPath := path.Join(store.ReceivesFolder, "."+file)
+	err := WriteSynced(stagedPath, []byte(fmt.Sprintf("%d %d", receives, generation)))
+
+	if err == nil {
+		err = store.Rename(stagedPath, countPath)
 	}
 
-	return message
+	return receives, generation, err
+}
+
+// Drops the receive count of a message which is no longer in its lifecycle.
+func (store *Store) Forget(file string) {
+	os.Remove(path.Join(store.ReceivesFolder, file))
 }
 
 func (store *Store) MessageSaver(i int) {
+	defer store.Working.Done()
+
 	for {
-		request := <-store.SaveRequests[i]
-		request.Response <- store.SaveRequestToFile(request)
+		select {
+		case request := <-store.SaveRequests[i]:
+			if request.Context.Err() != nil {
+				continue
+			}
+
+			err := store.SaveRequestToFile(request)
+
+			select {
+			case request.Response <- err:
+			case <-request.Context.Done():
+			}
+		case <-store.Quit:
+			return
+		}
 	}
 }
 
 func (store *Store) MessageFetcher(i int) {
+	defer store.Working.Done()
+
 	for {
-		request := <-store.FetchRequests[i]
-		request.Response <- store.FetchRequestFromFile(request)
+		select {
+		case request := <-store.FetchRequests[i]:
+			if request.Context.Err() != nil {
+				continue
+			}
+
+			if request.Lease != nil {
+				err := request.Lease()
+
+				select {
+				case request.Result <- err:
+				case <-request.Context.Done():
+				}
+
+				continue
+			}
+
+			message := store.FetchRequestFromFile(request)
+
+			// Nobody is left to read a message fetched too late, so it is
+			// released to be fetched again.
+			select {
+			case request.Response <- message:
+			case <-request.Context.Done():
+				if message != nil {
+					message.Body.Close()
+					store.Release(request.Queue, message)
+				}
+			}
+		case <-store.Quit:
+			return
+		}
 	}
 }
 
-func (store *Store) SaveQueue(queue *Queue) {
-	os.Mkdir(path.Join(store.QueuesFolder, queue.Id), 0777)
+func (store *Store) SaveQueue(ctx context.Context, queue *Queue) error {
+	queuePath := path.Join(store.QueuesFolder, queue.Id)
+	err := os.Mkdir(queuePath, 0777)
+
+	if err == nil {
+		err = store.SyncFolder(store.QueuesFolder)
+	}
+
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	// Without attributes, whatever the queue had before is kept.
+	if queue.Config == nil {
+		return nil
+	}
+
+	// The messages a queue already holds aren't moved between files and
+	// its log, so it keeps the storage it was created with.
+	if err != nil && store.FetchConfig(queue).Storage != queue.Config.Storage {
+		return ErrStorageChanged
+	}
+
+	content, err := json.Marshal(queue.Config)
+
+	if err != nil {
+		return err
+	}
+
+	// The attributes are written aside and flushed before they are moved
+	// into place, so neither a fetch nor a crash ever leaves a partial file.
+	configPath := path.Join(queuePath, ConfigFile)
+	err = WriteSynced(configPath+".tmp", content)
+
+	if err == nil {
+		err = store.Rename(configPath+".tmp", configPath)
+	}
+
+	if err == nil && queue.Config.Storage == "log" {
+		err = store.Log.SaveQueue(ctx, queue)
+	}
+
+	return err
 }
 
-func (store *Store) FetchQueue(queue *Queue) *Queue {
+func (store *Store) FetchQueue(ctx context.Context, queue *Queue) error {
 	_, err := os.Stat(path.Join(store.QueuesFolder, queue.Id))
 
 	if err != nil {
-		return nil
+		return ErrQueueNotFound
+	}
+
+	queue.Config = store.FetchConfig(queue)
+
+	return nil
+}
+
+// Reads the attributes of a queue. A queue which never set any, or whose
+// attributes can't be read, gets the server-wide behavior.
+func (store *Store) FetchConfig(queue *Queue) *QueueConfig {
+	config := &QueueConfig{}
+	content, err := ioutil.ReadFile(path.Join(store.QueuesFolder, queue.Id, ConfigFile))
+
+	if err == nil && json.Unmarshal(content, config) != nil {
+		log.Print("Ignoring unreadable attributes of queue ", queue.Id)
+		config = &QueueConfig{}
 	}
 
-	// No need to re-allocate, this queue exists. Simply return
-	// it to be used.
-	return queue
+	return config
 }
 
-func (store *Store) DeleteQueue(queue *Queue) {
-	os.RemoveAll(path.Join(store.QueuesFolder, queue.Id))
+func (store *Store) DeleteQueue(ctx context.Context, queue *Queue) error {
+	if log := store.LogOf(queue); log != nil {
+		log.DeleteQueue(ctx, queue)
+	}
+
+	store.Index.Drop(queue)
+
+	err := os.RemoveAll(path.Join(store.QueuesFolder, queue.Id))
+
+	// The receive counts of its messages go with it.
+	if infos, readErr := ioutil.ReadDir(store.ReceivesFolder); readErr == nil {
+		for _, info := range infos {
+			if strings.HasPrefix(info.Name(), queue.Id+":") {
+				os.Remove(path.Join(store.ReceivesFolder, info.Name()))
+			}
+		}
+	}
+
+	return err
 }
 
-func (store *Store) SaveMessage(queue *Queue, message *Message) bool {
+func (store *Store) SaveMessage(ctx context.Context, queue *Queue, message *Message) error {
+	config := store.FetchConfig(queue)
+
+	if config.Storage == "log" {
+		return store.Log.SaveMessage(ctx, queue, message)
+	}
+
+	// The mover would only set aside a message whose queue is missing.
+	if _, err := os.Stat(path.Join(store.QueuesFolder, queue.Id)); err != nil {
+		return ErrQueueNotFound
+	}
+
+	// A message of unknown size is taken to be as large as it may be, and
+	// accounted for with its real size once it is written.
+	size := message.Size
+
+	if size < 0 {
+		size = store.MessageSizeLimit(config)
+	}
+
+	err := store.Admit(queue, config, size)
+
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := store.WorkerContext(ctx)
+	defer cancel()
+
 	request := &SaveRequest{
+		Context:  ctx,
 		Queue:    queue,
 		Message:  message,
-		Response: make(chan bool),
+		Limit:    store.MessageSizeLimit(config),
+		Response: make(chan error),
 	}
 
 	// It doesn't matter which channel the request is dropped into. What
 	// we're concerned about here is this app server clobbering its peers
 	// on the same machine.
-	store.SaveRequests[rand.Intn(store.Workers)] <- request
+	select {
+	case store.SaveRequests[rand.Intn(store.Workers)] <- request:
+	default:
+		store.Account(queue, config, size, false, 0)
+		return ErrBusy
+	}
+
+	// A save which outlives its request may still complete, as the client
+	// has no way of telling it didn't. Until the queue's usage is read
+	// again, it is taken not to.
+	select {
+	case err = <-request.Response:
+	case <-ctx.Done():
+		err = Abandoned(ctx)
+	}
 
-	return <-request.Response
+	store.Account(queue, config, size, err == nil, message.Size)
+
+	return err
 }
 
-func (store *Store) FetchMessage(queue *Queue) *Message {
+func (store *Store) FetchMessage(ctx context.Context, queue *Queue) (*Message, error) {
+	config := store.FetchConfig(queue)
+
+	if config.Storage == "log" {
+		return store.Log.FetchMessage(ctx, queue)
+	}
+
+	ctx, cancel := store.WorkerContext(ctx)
+	defer cancel()
+
 	request := &FetchRequest{
+		Context:  ctx,
 		Queue:    queue,
+		Config:   config,
 		Response: make(chan *Message),
 	}
 
 	// All message fetch requests need to be serialized on a per-queue
 	// basis. This eliminates a "what's the next message in this queue" race
 	// on a per-app server basis.
-	store.FetchRequests[Checksum(queue.Id)%store.Workers] <- request
+	select {
+	case store.FetchRequests[Checksum(queue.Id)%store.Workers] <- request:
+	default:
+		return nil, ErrBusy
+	}
+
+	select {
+	case message := <-request.Response:
+		return message, nil
+	case <-ctx.Done():
+		return nil, Abandoned(ctx)
+	}
+}
+
+// Bounds the time a request to the workers may take, if there is a limit.
+func (store *Store) WorkerContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if store.WorkerTimeout > 0 {
+		return context.WithTimeout(ctx, store.WorkerTimeout)
+	}
+
+	return context.WithCancel(ctx)
+}
+
+// The error for a request given up on: ErrBusy when it ran out of time, or
+// the reason it was cancelled otherwise.
+func Abandoned(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrBusy
+	}
+
+	return ctx.Err()
+}
+
+// Runs a change to the lease of a message on its queue's fetch worker, and
+// waits for it like FetchMessage does.
+func (store *Store) LeaseOnWorker(ctx context.Context, queue *Queue, lease func() error) error {
+	ctx, cancel := store.WorkerContext(ctx)
+	defer cancel()
+
+	request := &FetchRequest{
+		Context: ctx,
+		Queue:   queue,
+		Lease:   lease,
+		Result:  make(chan error),
+	}
+
+	select {
+	case store.FetchRequests[Checksum(queue.Id)%store.Workers] <- request:
+	default:
+		return ErrBusy
+	}
+
+	select {
+	case err := <-request.Result:
+		return err
+	case <-ctx.Done():
+		return Abandoned(ctx)
+	}
+}
+
+func (store *Store) ReleaseMessage(ctx context.Context, queue *Queue, message *Message) error {
+	if log := store.LogOf(queue); log != nil {
+		return log.ReleaseMessage(ctx, queue, message)
+	}
+
+	return store.LeaseOnWorker(ctx, queue, func() error {
+		return store.Release(queue, message)
+	})
+}
+
+// Moves a delayed message back into its queue, ahead of the mover. Only ever
+// run by the queue's fetch worker.
+func (store *Store) Release(queue *Queue, message *Message) error {
+	delayPath, err := store.LeasedPath(queue, message)
+
+	if err != nil {
+		return err
+	}
+
+	if store.Deliver(delayPath, queue, message.Id) != nil {
+		return ErrLeaseLost
+	}
+
+	return nil
+}
+
+func (store *Store) ExtendMessage(ctx context.Context, queue *Queue, message *Message, visibility time.Duration) error {
+	if log := store.LogOf(queue); log != nil {
+		return log.ExtendMessage(ctx, queue, message, visibility)
+	}
+
+	return store.LeaseOnWorker(ctx, queue, func() error {
+		return store.Extend(queue, message, visibility)
+	})
+}
+
+// Pushes back the deadline of a delayed message, and starts a new generation
+// of its lease. Only ever run by the queue's fetch worker.
+func (store *Store) Extend(queue *Queue, message *Message, visibility time.Duration) error {
+	delayPath, err := store.LeasedPath(queue, message)
+
+	if err != nil {
+		return err
+	}
+
+	// The mover holds on to a delayed message for as long as its
+	// modification time is in the future.
+	deadline := time.Now().Add(visibility)
+
+	if os.Chtimes(delayPath, deadline, deadline) != nil {
+		return ErrLeaseLost
+	}
+
+	_, generation, err := store.Renew(queue.Id+":"+message.Id, false)
+
+	if err != nil {
+		return err
+	}
+
+	message.Receipt = strconv.FormatInt(generation, 10)
+
+	return nil
+}
+
+// The path of a message in the delay folder, as long as it is still under the
+// lease its receipt is of.
+func (store *Store) LeasedPath(queue *Queue, message *Message) (string, error) {
+	file := queue.Id + ":" + message.Id
+	delayPath := path.Join(store.DelayFolder, file)
+	_, generation := store.Receives(file)
+
+	if message.Receipt == "" || strconv.FormatInt(generation, 10) != message.Receipt {
+		return "", ErrLeaseLost
+	}
+
+	if _, err := os.Stat(delayPath); err != nil {
+		return "", ErrLeaseLost
+	}
+
+	return delayPath, nil
+}
+
+func (store *Store) ListMessages(ctx context.Context, queue *Queue) ([]string, error) {
+	if log := store.LogOf(queue); log != nil {
+		return log.ListMessages(ctx, queue)
+	}
+
+	buckets, err := store.Buckets(queue)
+
+	if err != nil {
+		return nil, ErrQueueNotFound
+	}
+
+	var messageIds []string
+
+	// A sharded queue may have many buckets to read.
+	for _, bucketPath := range buckets {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if queueDir, err := os.Open(bucketPath); err == nil {
+			messageIds = append(messageIds, ReadMessageIds(queueDir, -1)...)
+			queueDir.Close()
+		}
+	}
 
-	return <-request.Response
+	return messageIds, nil
 }
 
-func (store *Store) DeleteMessage(queue *Queue, message *Message) bool {
+// Every path a message can have, from the end of its lifecycle to the start:
+// removed, delayed, in its queue and new.
+func (store *Store) MessagePaths(queue *Queue, message *Message) []string {
 	file := queue.Id + ":" + message.Id
-	sources := [3]string{
-		path.Join(store.QueuesFolder, queue.Id, message.Id),
+
+	return []string{
+		path.Join(store.RemoveFolder, file),
 		path.Join(store.DelayFolder, file),
+		store.QueuePath(queue, message.Id),
 		path.Join(store.NewFolder, file),
 	}
+}
+
+func (store *Store) StatMessage(ctx context.Context, queue *Queue, message *Message) (*Message, error) {
+	if log := store.LogOf(queue); log != nil {
+		return log.StatMessage(ctx, queue, message)
+	}
+
+	for _, source := range store.MessagePaths(queue, message)[1:] {
+		info, err := os.Stat(source)
+
+		if err == nil {
+			return &Message{Id: message.Id, Size: info.Size()}, nil
+		}
+	}
+
+	return nil, ErrMessageNotFound
+}
+
+func (store *Store) OpenMessage(ctx context.Context, queue *Queue, message *Message) (*Message, error) {
+	if log := store.LogOf(queue); log != nil {
+		return log.OpenMessage(ctx, queue, message)
+	}
+
+	for _, source := range store.MessagePaths(queue, message)[1:] {
+		messageFile, err := os.Open(source)
+
+		if err != nil {
+			continue
+		}
+
+		info, err := messageFile.Stat()
+
+		if err != nil {
+			messageFile.Close()
+			continue
+		}
+
+		return &Message{
+			Id:   message.Id,
+			Size: info.Size(),
+			Body: messageFile,
+		}, nil
+	}
+
+	return nil, ErrMessageNotFound
+}
+
+func (store *Store) DeleteMessage(ctx context.Context, queue *Queue, message *Message) error {
+	if log := store.LogOf(queue); log != nil {
+		return log.DeleteMessage(ctx, queue, message)
+	}
+
+	return store.LeaseOnWorker(ctx, queue, func() error {
+		return store.Delete(queue, message)
+	})
+}
+
+// Moves a message to the remove folder, wherever it is. Only ever run by the
+// queue's fetch worker.
+func (store *Store) Delete(queue *Queue, message *Message) error {
+	file := queue.Id + ":" + message.Id
+	sources := store.MessagePaths(queue, message)[2:]
+
+	// A delayed message is leased, and only its current receipt deletes it.
+	// A receipt deletes nothing else, as its lease is over once the message
+	// is out of the delay folder.
+	_, err := os.Stat(path.Join(store.DelayFolder, file))
+
+	if err == nil || message.Receipt != "" {
+		delayPath, err := store.LeasedPath(queue, message)
+
+		if err != nil {
+			return err
+		}
+
+		sources = []string{delayPath}
+	}
 
 	for _, source := range sources {
-		err := os.Rename(source, path.Join(store.RemoveFolder, file))
+		err := store.Discard(source, file)
+
+		if err == nil {
+			store.Index.Remove(queue, message.Id)
+			return nil
+		}
+	}
+
+	return ErrMessageNotFound
+}
+
+// Delivers a removed message to its queue again. Only messages the reaper
+// retains are still there to be replayed.
+func (store *Store) ReplayMessage(ctx context.Context, queue *Queue, message *Message) error {
+	if log := store.LogOf(queue); log != nil {
+		return log.ReplayMessage(ctx, queue, message)
+	}
+
+	if err := store.FetchQueue(ctx, queue); err != nil {
+		return err
+	}
+
+	err := store.Deliver(path.Join(store.RemoveFolder, queue.Id+":"+message.Id), queue, message.Id)
+
+	if os.IsNotExist(err) {
+		return ErrMessageNotFound
+	}
+
+	return err
+}
+
+// Messages whose IDs aren't time based UUIDs have no creation time, and are
+// never in range.
+func (store *Store) ReplayMessages(ctx context.Context, queue *Queue, from time.Time, to time.Time) (int, error) {
+	if log := store.LogOf(queue); log != nil {
+		return log.ReplayMessages(ctx, queue, from, to)
+	}
+
+	if err := store.FetchQueue(ctx, queue); err != nil {
+		return 0, err
+	}
+
+	infos, err := ioutil.ReadDir(store.RemoveFolder)
+
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+
+	for _, info := range infos {
+		removed, message := ParseMessageFile(info.Name())
+
+		if removed == nil || removed.Id != queue.Id {
+			continue
+		}
+
+		created := spool.UUIDTime(message.Id)
+
+		if created.IsZero() || created.Before(from) || !to.IsZero() && !created.Before(to) {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return replayed, err
+		}
+
+		// The queue was checked once above. One pruned in the meantime is
+		// simply no longer retained.
+		err := store.Deliver(path.Join(store.RemoveFolder, info.Name()), queue, message.Id)
 
 		if err == nil {
-			return true
+			replayed += 1
+		} else if !os.IsNotExist(err) {
+			return replayed, err
 		}
 	}
 
-	return false
+	return replayed, nil
 }
@@ -1,22 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"github.com/softlayer/mq/spool"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"testing"
+	"time"
 )
 
 var (
 	testWorkers    int    = 1
 	testPeers      int    = 0
-	testRoot       string = "/tmp/mq-test"
 	queueId        string = "q"
 	messageId      string = "m"
 	messageContent []byte = []byte("abcdefghijklmnopqrstuvwxyz")
 )
 
-func setup() *Store {
-	store := NewStore(testWorkers, testPeers, testRoot)
+// Every test gets a root of its own, removed once it is done.
+func setup(t testing.TB) *Store {
+	store := NewStore(testWorkers, testPeers, t.TempDir())
+	store.Strict = true
 
 	store.PrepareFolders()
 	store.PrepareWorkers()
@@ -24,63 +31,70 @@ func setup() *Store {
 	return store
 }
 
-func teardown() {
-	os.RemoveAll(testRoot)
+func newMessage(id string, content []byte) *Message {
+	return &Message{
+		Id:   id,
+		Size: int64(len(content)),
+		Body: ioutil.NopCloser(bytes.NewReader(content)),
+	}
 }
 
 func TestFolderCreation(t *testing.T) {
-	store := setup()
+	store := setup(t)
 
 	folders := make(map[string]string)
 	folders["root"] = store.Root
+	folders["tmp"] = store.StagingFolder
 	folders["new"] = store.NewFolder
 	folders["delay"] = store.DelayFolder
 	folders["queues"] = store.QueuesFolder
+	folders["invalid"] = store.InvalidFolder
+	folders["receives"] = store.ReceivesFolder
 
 	for name, folder := range folders {
 		if os.Chdir(folder) != nil {
 			t.Error("Could not change to", name, "folder at", folder)
 		}
 	}
-
-	teardown()
 }
 
 func TestQueueLifecycle(t *testing.T) {
-	store := setup()
+	ctx := context.Background()
+
+	store := setup(t)
 
 	queue := &Queue{Id: queueId}
 	queuePath := path.Join(store.QueuesFolder, queue.Id)
 
 	// Can we create a queue?
-	store.SaveQueue(queue)
+	store.SaveQueue(ctx, queue)
 
 	if os.Chdir(queuePath) != nil {
 		t.Error("Could not create queue directory structure")
 	}
 
 	// Can we verify a queue exists after creation?
-	if store.FetchQueue(queue) == nil {
+	if store.FetchQueue(ctx, queue) != nil {
 		t.Error("Could not verify queue exists after creation")
 	}
 
 	// Can we delete a queue and be certain it no longer exists?
-	store.DeleteQueue(queue)
+	store.DeleteQueue(ctx, queue)
 
 	if os.Chdir(queuePath) == nil {
 		t.Error("Queue directory wasn't properly destroyed")
 	}
-
-	teardown()
 }
 
 func TestMessageLifecycle(t *testing.T) {
-	store := setup()
+	ctx := context.Background()
+
+	store := setup(t)
 
 	file := queueId + ":" + messageId
 
 	queue := &Queue{Id: queueId}
-	message := &Message{Id: messageId, Content: messageContent}
+	message := newMessage(messageId, messageContent)
 
 	// All the pathing we will need to check as the message moves through its
 	// lifecycle.
@@ -88,8 +102,8 @@ func TestMessageLifecycle(t *testing.T) {
 	messagePathAvailable := path.Join(store.QueuesFolder, queueId, messageId)
 	messagePathDelay := path.Join(store.DelayFolder, file)
 
-	store.SaveQueue(queue)
-	store.SaveMessage(queue, message)
+	store.SaveQueue(ctx, queue)
+	store.SaveMessage(ctx, queue, message)
 
 	stat, err := os.Stat(messagePathNew)
 
@@ -110,12 +124,21 @@ func TestMessageLifecycle(t *testing.T) {
 	// mechanism has no idea how to sort messages.
 	os.Rename(messagePathNew, messagePathAvailable)
 
-	// When we fetch a message, it should contain the same ID we saved to the
-	// new folder.
-	if store.FetchMessage(queue).Id != message.Id {
+	// When we fetch a message, it should contain the same ID and content we
+	// saved to the new folder.
+	fetched, err := store.FetchMessage(ctx, queue)
+
+	if err != nil || fetched.Id != message.Id {
 		t.Error("Unable to fetch correct message")
 	}
 
+	content, _ := ioutil.ReadAll(fetched.Body)
+	fetched.Body.Close()
+
+	if !bytes.Equal(content, messageContent) {
+		t.Error("Fetched message with incorrect content")
+	}
+
 	// Verify after we fetched the message was temporarily moved to the delay
 	// folder.
 	stat, err = os.Stat(messagePathDelay)
@@ -132,8 +155,12 @@ func TestMessageLifecycle(t *testing.T) {
 		t.Error("Message moved with incorrect file content")
 	}
 
-	// Finally, delete the message.
-	if store.DeleteMessage(queue, message) == false {
+	// Finally, delete the message. Only the receipt of the lease does.
+	if store.DeleteMessage(ctx, queue, message) != ErrLeaseLost {
+		t.Error("Deleted a leased message without its receipt")
+	}
+
+	if store.DeleteMessage(ctx, queue, fetched) != nil {
 		t.Error("Could not delete message")
 	}
 
@@ -151,20 +178,791 @@ func TestMessageLifecycle(t *testing.T) {
 	if os.Remove(messagePathDelay) == nil {
 		t.Error("Found message file in 'delay'")
 	}
+}
+
+func TestMessageRelease(t *testing.T) {
+	ctx := context.Background()
+
+	store := setup(t)
+
+	queue := &Queue{Id: queueId}
+	store.SaveQueue(ctx, queue)
+
+	// Simulate the mover delivering a new message.
+	ioutil.WriteFile(path.Join(store.QueuesFolder, queueId, messageId), messageContent, 0666)
+
+	messageIds, err := store.ListMessages(ctx, queue)
+
+	if err != nil || len(messageIds) != 1 || messageIds[0] != messageId {
+		t.Error("Could not list message waiting in queue")
+	}
+
+	message, _ := store.FetchMessage(ctx, queue)
+	message.Body.Close()
+
+	if messageIds, _ = store.ListMessages(ctx, queue); len(messageIds) != 0 {
+		t.Error("Listed message after fetching it")
+	}
+
+	if stat, err := store.StatMessage(ctx, queue, message); err != nil || stat.Size != int64(len(messageContent)) {
+		t.Error("Could not stat message after fetching it")
+	}
+
+	// Once released, the message can be fetched again right away.
+	if store.ReleaseMessage(ctx, queue, message) != nil {
+		t.Error("Could not release message")
+	}
+
+	if message, _ = store.FetchMessage(ctx, queue); message == nil || message.Id != messageId {
+		t.Error("Could not fetch message after releasing it")
+	} else {
+		message.Body.Close()
+	}
+}
+
+func TestLeaseReceipts(t *testing.T) {
+	ctx := context.Background()
+
+	store := setup(t)
+
+	queue := &Queue{Id: queueId}
+	store.SaveQueue(ctx, queue)
+	ioutil.WriteFile(path.Join(store.QueuesFolder, queueId, messageId), messageContent, 0666)
+
+	first, _ := store.FetchMessage(ctx, queue)
+	first.Body.Close()
+
+	// The message is fetched again once its lease is over.
+	store.ReleaseMessage(ctx, queue, first)
+	second, _ := store.FetchMessage(ctx, queue)
+	second.Body.Close()
+
+	if first.Receipt == "" || first.Receipt == second.Receipt {
+		t.Fatal("Fetched message again with the same receipt")
+	}
+
+	if store.DeleteMessage(ctx, queue, first) != ErrLeaseLost {
+		t.Error("Deleted a message with the receipt of a lease which is over")
+	}
+
+	// Extending a lease replaces its receipt.
+	extended := &Message{Id: second.Id, Receipt: second.Receipt}
+
+	if store.ExtendMessage(ctx, queue, extended, time.Hour) != nil || extended.Receipt == second.Receipt {
+		t.Fatal("Could not extend lease")
+	}
+
+	if store.ExtendMessage(ctx, queue, second, time.Hour) != ErrLeaseLost {
+		t.Error("Extended a lease with the receipt it replaced")
+	}
+
+	if store.DeleteMessage(ctx, queue, extended) != nil {
+		t.Error("Could not delete a message with the receipt of its lease")
+	}
+
+	// Its receive count is forgotten once deleted, but a lease of the
+	// message replayed is still a new one.
+	store.ReplayMessage(ctx, queue, &Message{Id: messageId})
+	third, _ := store.FetchMessage(ctx, queue)
+
+	if third == nil {
+		t.Fatal("Could not fetch replayed message")
+	}
+
+	third.Body.Close()
+
+	if store.DeleteMessage(ctx, queue, extended) != ErrLeaseLost {
+		t.Error("Deleted a replayed message with the receipt of a lease before it")
+	}
+
+	if store.Race != 0 || store.Duplicate != 0 {
+		t.Error("Lost a claim without any other fetch", store.Race, store.Duplicate)
+	}
+}
+
+func TestLeasesOnWorker(t *testing.T) {
+	ctx := context.Background()
+
+	store := NewStore(testWorkers, testPeers, t.TempDir())
+	store.PrepareFolders()
+
+	// Nothing takes fetch requests, so no lease changes either.
+	store.FetchRequests = []chan *FetchRequest{make(chan *FetchRequest)}
+
+	queue := &Queue{Id: queueId}
+	store.SaveQueue(ctx, queue)
+	ioutil.WriteFile(path.Join(store.QueuesFolder, queueId, messageId), messageContent, 0666)
+
+	if store.DeleteMessage(ctx, queue, &Message{Id: messageId}) != ErrBusy {
+		t.Error("Deleted a message without the queue's fetch worker")
+	}
+
+	if _, err := os.Stat(path.Join(store.QueuesFolder, queueId, messageId)); err != nil {
+		t.Error("Could not find message after a busy delete")
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	ctx := context.Background()
+
+	store := setup(t)
+
+	deadLetterQueue := &Queue{Id: "dead"}
+	queue := &Queue{Id: queueId, Config: &QueueConfig{MaxReceiveCount: 1, DeadLetterQueue: deadLetterQueue.Id}}
+
+	store.SaveQueue(ctx, deadLetterQueue)
+	store.SaveQueue(ctx, queue)
+	ioutil.WriteFile(path.Join(store.QueuesFolder, queueId, messageId), messageContent, 0666)
+
+	fetched, _ := store.FetchMessage(ctx, queue)
+	fetched.Body.Close()
+	store.ReleaseMessage(ctx, queue, fetched)
+
+	// A second delivery is one too many.
+	if fetched, _ = store.FetchMessage(ctx, queue); fetched != nil {
+		t.Error("Delivered a message beyond its receive count")
+	}
+
+	if messageIds, _ := store.ListMessages(ctx, deadLetterQueue); len(messageIds) != 1 || messageIds[0] != messageId {
+		t.Error("Message wasn't moved to the dead letter queue")
+	}
+}
+
+func TestSharedReceives(t *testing.T) {
+	ctx := context.Background()
+
+	store := setup(t)
+
+	file := queueId + ":" + messageId
+	queue := &Queue{Id: queueId, Config: &QueueConfig{MaxReceiveCount: 1}}
+	store.SaveQueue(ctx, queue)
+	ioutil.WriteFile(path.Join(store.QueuesFolder, queueId, messageId), messageContent, 0666)
+
+	fetched, _ := store.FetchMessage(ctx, queue)
+	fetched.Body.Close()
+	store.ReleaseMessage(ctx, queue, fetched)
+	store.Close(ctx)
+
+	// A peer sharing the root, or the same daemon once restarted, knows
+	// about the first receive.
+	peer := NewStore(testWorkers, testPeers, store.Root)
+	peer.PrepareFolders()
+	peer.PrepareWorkers()
+
+	if fetched, _ = peer.FetchMessage(ctx, queue); fetched != nil {
+		t.Error("Delivered a message beyond its receive count after a restart")
+	}
+
+	// Without a dead letter queue it is discarded, and its count with it.
+	if _, err := os.Stat(path.Join(peer.RemoveFolder, file)); err != nil {
+		t.Error("Message beyond its receive count wasn't discarded")
+	}
+
+	if _, err := os.Stat(path.Join(peer.ReceivesFolder, file)); err == nil {
+		t.Error("Found the receive count of a discarded message")
+	}
+
+	peer.Close(ctx)
+}
+
+func TestRetention(t *testing.T) {
+	ctx := context.Background()
+
+	store := setup(t)
+
+	queue := &Queue{Id: queueId, Config: &QueueConfig{Retention: 60}}
+	store.SaveQueue(ctx, queue)
+
+	// Created in 1582, long past the queue's retention.
+	expired := "00000000-0000-1000-8000-000000000000"
+	current := spool.TimeUUID()
+
+	for _, id := range []string{expired, current} {
+		ioutil.WriteFile(path.Join(store.QueuesFolder, queueId, id), messageContent, 0666)
+	}
+
+	for range 2 {
+		if fetched, _ := store.FetchMessage(ctx, queue); fetched != nil {
+			fetched.Body.Close()
+
+			if fetched.Id == expired {
+				t.Error("Delivered a message past the queue's retention")
+			}
+		}
+	}
+
+	if _, err := os.Stat(path.Join(store.RemoveFolder, queueId+":"+expired)); err != nil {
+		t.Error("Message past the queue's retention wasn't discarded")
+	}
+
+	if _, err := os.Stat(path.Join(store.DelayFolder, queueId+":"+current)); err != nil {
+		t.Error("Message within the queue's retention wasn't delivered")
+	}
+}
+
+func TestFifo(t *testing.T) {
+	ctx := context.Background()
+
+	store := setup(t)
+	store.Peers = 8
+
+	queue := &Queue{Id: queueId, Config: &QueueConfig{Fifo: true}}
+	store.SaveQueue(ctx, queue)
+
+	var messageIds []string
+
+	for i := 0; i < 8; i++ {
+		messageIds = append(messageIds, spool.TimeUUID())
+	}
+
+	// Delivered out of order, fetched in order regardless of peers.
+	for i := len(messageIds) - 1; i >= 0; i-- {
+		ioutil.WriteFile(path.Join(store.QueuesFolder, queueId, messageIds[i]), messageContent, 0666)
+	}
+
+	for _, messageId := range messageIds {
+		fetched, _ := store.FetchMessage(ctx, queue)
+
+		if fetched == nil || fetched.Id != messageId {
+			t.Fatal("Fetched messages out of order")
+		}
+
+		fetched.Body.Close()
+	}
+}
+
+func TestReplay(t *testing.T) {
+	ctx := context.Background()
+
+	store := setup(t)
+
+	queue := &Queue{Id: queueId}
+	store.SaveQueue(ctx, queue)
+	ioutil.WriteFile(path.Join(store.QueuesFolder, queueId, messageId), messageContent, 0666)
+
+	fetched, _ := store.FetchMessage(ctx, queue)
+	fetched.Body.Close()
+	store.DeleteMessage(ctx, queue, fetched)
+
+	// Removed messages are stamped with when they were removed, whatever
+	// their lease said.
+	removePath := path.Join(store.RemoveFolder, queueId+":"+messageId)
+
+	if info, err := os.Stat(removePath); err != nil || time.Since(info.ModTime()) > time.Minute {
+		t.Error("Removed message wasn't stamped")
+	}
+
+	if store.ReplayMessage(ctx, queue, &Message{Id: messageId}) != nil {
+		t.Fatal("Could not replay a retained message")
+	}
+
+	if fetched, _ = store.FetchMessage(ctx, queue); fetched == nil || fetched.Id != messageId {
+		t.Fatal("Replayed message wasn't delivered")
+	}
+
+	fetched.Body.Close()
+
+	if store.ReplayMessage(ctx, queue, &Message{Id: messageId}) != ErrMessageNotFound {
+		t.Error("Replayed a message which wasn't removed")
+	}
+
+	if store.ReplayMessage(ctx, &Queue{Id: "gone"}, &Message{Id: messageId}) != ErrQueueNotFound {
+		t.Error("Replayed a message of a missing queue")
+	}
+}
+
+func TestReplayRange(t *testing.T) {
+	ctx := context.Background()
+
+	store := setup(t)
+
+	queue := &Queue{Id: queueId}
+	store.SaveQueue(ctx, queue)
+
+	remove := func(file string) {
+		ioutil.WriteFile(path.Join(store.RemoveFolder, file), messageContent, 0666)
+	}
+
+	// Only the IDs tell when each was created.
+	before := spool.TimeUUID()
+	time.Sleep(10 * time.Millisecond)
+	from := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	within := spool.TimeUUID()
+	time.Sleep(10 * time.Millisecond)
+	to := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	after := spool.TimeUUID()
+
+	for _, file := range []string{queueId + ":" + before, queueId + ":" + within, queueId + ":" + after, queueId + ":legacy", "other:" + within} {
+		remove(file)
+	}
+
+	if replayed, err := store.ReplayMessages(ctx, queue, from, to); err != nil || replayed != 1 {
+		t.Error("Unexpected replay within a range", replayed, err)
+	}
+
+	if messageIds, _ := store.ListMessages(ctx, queue); len(messageIds) != 1 || messageIds[0] != within {
+		t.Error("Replayed the wrong messages", messageIds)
+	}
+
+	// Open ended on both sides, only what is left of the queue's own.
+	if replayed, _ := store.ReplayMessages(ctx, queue, time.Time{}, time.Time{}); replayed != 2 {
+		t.Error("Unexpected replay of an open range", replayed)
+	}
+
+	if _, err := os.Stat(path.Join(store.RemoveFolder, queueId+":legacy")); err != nil {
+		t.Error("Replayed a message without a creation time")
+	}
+
+	if _, err := store.ReplayMessages(ctx, &Queue{Id: "gone"}, from, to); err != ErrQueueNotFound {
+		t.Error("Replayed messages of a missing queue")
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	ctx := context.Background()
+
+	store := setup(t)
+	store.MaxQueueMessages = 2
+
+	queue := &Queue{Id: queueId, Config: &QueueConfig{MaxBytes: int64(len(messageContent)) + 1}}
+	store.SaveQueue(ctx, queue)
+
+	// A message larger than the server allows is refused outright.
+	store.MaxMessageSize = int64(len(messageContent)) - 1
+
+	if store.SaveMessage(ctx, queue, newMessage(spool.TimeUUID(), messageContent)) != ErrMessageTooLarge {
+		t.Error("Saved a message larger than the server allows")
+	}
+
+	store.MaxMessageSize = 0
+
+	if store.SaveMessage(ctx, queue, newMessage(spool.TimeUUID(), messageContent)) != nil {
+		t.Error("Could not save a message within limits")
+	}
+
+	// The queue's own byte limit is smaller than the server's, so it wins.
+	if store.SaveMessage(ctx, queue, newMessage(spool.TimeUUID(), messageContent)) != ErrQueueTooLarge {
+		t.Error("Saved a message beyond the queue's byte limit")
+	}
+
+	if store.SaveMessage(ctx, queue, newMessage(spool.TimeUUID(), nil)) != nil {
+		t.Error("Could not save an empty message within limits")
+	}
+
+	if store.SaveMessage(ctx, queue, newMessage(spool.TimeUUID(), nil)) != ErrQueueFull {
+		t.Error("Saved a message beyond the server's message limit")
+	}
+
+	// A message of unknown size is charged as large as it may be, so it
+	// doesn't slip past the queue's byte limit.
+	message := newMessage(spool.TimeUUID(), messageContent)
+	message.Size = -1
+	store.MaxQueueMessages = 0
+	store.MaxMessageSize = int64(len(messageContent)) - 1
+
+	if store.SaveMessage(ctx, queue, message) != ErrQueueTooLarge {
+		t.Error("Saved a message of unknown size beyond the queue's byte limit")
+	}
+
+	// Otherwise, it is stopped once it proves too large, and nothing of it
+	// is left behind.
+	queue.Config = &QueueConfig{}
+	store.SaveQueue(ctx, queue)
+
+	message = newMessage(spool.TimeUUID(), messageContent)
+	message.Size = -1
+
+	if store.SaveMessage(ctx, queue, message) != ErrMessageTooLarge {
+		t.Error("Saved a message of unknown size larger than the server allows")
+	}
+
+	if _, err := os.Stat(path.Join(store.NewFolder, queueId+":"+message.Id)); err == nil {
+		t.Error("Found partial message file in 'new'")
+	}
+}
+
+func TestUsageReading(t *testing.T) {
+	ctx := context.Background()
+
+	store := setup(t)
+	store.MaxQueueMessages = 2
+
+	queue := &Queue{Id: queueId}
+	store.SaveQueue(ctx, queue)
+
+	for i := 0; i < 2; i++ {
+		if err := store.SaveMessage(ctx, queue, newMessage(spool.TimeUUID(), messageContent)); err != nil {
+			t.Fatal("Could not save a message within limits:", err)
+		}
+	}
+
+	// No mover runs, so both messages are still in 'new' when the queue's
+	// usage is read again.
+	store.Usage[queueId].Read = time.Time{}
+
+	if store.SaveMessage(ctx, queue, newMessage(spool.TimeUUID(), messageContent)) != ErrQueueFull {
+		t.Error("Messages in 'new' didn't count against the queue")
+	}
+
+	if usage := store.Usage[queueId]; usage.Messages != 2 || usage.Pending != 0 {
+		t.Error("Unexpected usage:", usage.Messages, usage.Pending)
+	}
+}
+
+func TestLimitRefunds(t *testing.T) {
+	ctx := context.Background()
+
+	store := setup(t)
+	store.MaxMessageSize = int64(len(messageContent)) - 1
+
+	queue := &Queue{Id: queueId, Config: &QueueConfig{MaxMessages: 1}}
+	store.SaveQueue(ctx, queue)
+
+	// Admitted as its size is unknown, then found too large while writing.
+	message := newMessage(spool.TimeUUID(), messageContent)
+	message.Size = -1
+
+	if store.SaveMessage(ctx, queue, message) != ErrMessageTooLarge {
+		t.Error("Saved a message of unknown size larger than the server allows")
+	}
+
+	// The failed save no longer takes up the queue's only place.
+	if err := store.SaveMessage(ctx, queue, newMessage(spool.TimeUUID(), nil)); err != nil {
+		t.Error("Failed save still counted against the queue:", err)
+	}
+
+	// A message of unknown size counts with the size it turned out to have.
+	store.MaxMessageSize = 0
+
+	queue = &Queue{Id: "chunked", Config: &QueueConfig{MaxBytes: int64(len(messageContent)) + 1}}
+	store.SaveQueue(ctx, queue)
+
+	message = newMessage(spool.TimeUUID(), messageContent)
+	message.Size = -1
+
+	if err := store.SaveMessage(ctx, queue, message); err != nil || message.Size != int64(len(messageContent)) {
+		t.Error("Could not save a message of unknown size:", err)
+	}
+
+	if store.SaveMessage(ctx, queue, newMessage(spool.TimeUUID(), messageContent)) != ErrQueueTooLarge {
+		t.Error("Message of unknown size didn't count against the queue")
+	}
+}
+
+func TestWorkerTimeout(t *testing.T) {
+	ctx := context.Background()
+
+	store := setup(t)
+	store.WorkerTimeout = 50 * time.Millisecond
+
+	queue := &Queue{Id: queueId}
+	store.SaveQueue(ctx, queue)
+
+	// A body which never arrives keeps the only worker busy.
+	reader, writer := io.Pipe()
+	defer writer.Close()
+
+	if store.SaveMessage(ctx, queue, &Message{Id: spool.TimeUUID(), Size: -1, Body: reader}) != ErrBusy {
+		t.Error("Waited for a stuck worker")
+	}
+
+	if store.SaveMessage(ctx, queue, newMessage(spool.TimeUUID(), messageContent)) != ErrBusy {
+		t.Error("Waited behind a stuck worker")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if _, err := store.FetchMessage(cancelled, queue); err != context.Canceled {
+		t.Error("Fetched for a request which was cancelled", err)
+	}
+}
+
+func TestCancelledSave(t *testing.T) {
+	store := setup(t)
+
+	queue := &Queue{Id: queueId}
+	store.SaveQueue(context.Background(), queue)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, writer := io.Pipe()
+	saved := make(chan error)
+
+	go func() {
+		saved <- store.SaveMessage(ctx, queue, &Message{Id: spool.TimeUUID(), Size: -1, Body: reader})
+	}()
+
+	writer.Write(messageContent)
+	cancel()
+
+	if err := <-saved; err != context.Canceled {
+		t.Error("Saved a message for a request which was cancelled", err)
+	}
+
+	// The worker stops once it reads again, and removes what it wrote.
+	writer.Close()
+	store.Close(context.Background())
+
+	if files, _ := ioutil.ReadDir(store.NewFolder); len(files) != 0 {
+		t.Error("Found a message saved for a request which was cancelled")
+	}
+}
+
+func TestAbandonedWrite(t *testing.T) {
+	store := setup(t)
+
+	queue := &Queue{Id: queueId}
+	store.SaveQueue(context.Background(), queue)
+
+	reader, writer := io.Pipe()
+	saved := make(chan error)
+
+	go func() {
+		saved <- store.SaveMessage(context.Background(), queue, &Message{Id: messageId, Size: -1, Body: reader})
+	}()
+
+	writer.Write(messageContent)
+
+	// Stopping runs out of time while the message is still being written.
+	stopped, stop := context.WithCancel(context.Background())
+	stop()
+
+	if store.Close(stopped) {
+		t.Error("Stopped while a message was still being written")
+	}
+
+	stagedPath := path.Join(store.StagingFolder, queueId+":"+messageId)
+
+	if _, err := os.Stat(stagedPath); err != nil {
+		t.Error("Removed a message its worker still owns")
+	}
+
+	// Its worker finishes writing, and removes it rather than hand it over.
+	writer.Close()
+
+	if err := <-saved; err != ErrNotSaved {
+		t.Error("Saved an abandoned message", err)
+	}
+
+	for _, folder := range []string{store.StagingFolder, store.NewFolder} {
+		if files, _ := ioutil.ReadDir(folder); len(files) != 0 {
+			t.Error("Found an abandoned message in", folder)
+		}
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	ctx := context.Background()
+
+	store := setup(t)
+	store.Visibility = time.Minute
+
+	queue := &Queue{Id: queueId}
+	store.SaveQueue(ctx, queue)
+
+	write := func(folder string, file string, content []byte, age time.Duration) string {
+		filePath := path.Join(folder, file)
+		ioutil.WriteFile(filePath, content, 0666)
+		os.Chtimes(filePath, time.Now().Add(-age), time.Now().Add(-age))
+		return filePath
+	}
+
+	staged := write(store.StagingFolder, queueId+":staged", messageContent[:1], time.Hour)
+	writing := write(store.StagingFolder, queueId+":writing", messageContent[:1], 0)
+	pending := write(store.NewFolder, queueId+":pending", messageContent, 0)
+	orphan := write(store.NewFolder, "gone:orphan", messageContent, 0)
+	invalid := write(store.NewFolder, "invalid", messageContent, 0)
+	expired := write(store.DelayFolder, queueId+":expired", messageContent, time.Hour)
+	leased := write(store.DelayFolder, queueId+":leased", messageContent, 0)
+	extended := write(store.DelayFolder, queueId+":extended", messageContent, -time.Hour)
+	write(store.RemoveFolder, queueId+":removed", messageContent, 0)
+	removed := write(store.DelayFolder, queueId+":removed", messageContent, 0)
+	counted := write(store.ReceivesFolder, queueId+":leased", []byte("1"), 0)
+	stale := write(store.ReceivesFolder, queueId+":removed", []byte("1"), 0)
+
+	recovery := store.Recover()
+
+	if recovery.Delivered != 1 || recovery.Requeued != 1 || recovery.Removed != 1 || recovery.RolledBack != 1 || recovery.Orphaned != 1 || recovery.Invalid != 1 {
+		t.Error("Unexpected recovery summary", *recovery)
+	}
+
+	for _, gone := range []string{staged, pending, orphan, invalid, expired, removed, stale} {
+		if _, err := os.Stat(gone); err == nil {
+			t.Error("Found", gone, "after recovery")
+		}
+	}
+
+	for _, kept := range []string{writing, leased, extended, counted, path.Join(store.QueuesFolder, queueId, "pending"), path.Join(store.QueuesFolder, queueId, "expired"), path.Join(store.InvalidFolder, "invalid")} {
+		if _, err := os.Stat(kept); err != nil {
+			t.Error("Could not find", kept, "after recovery")
+		}
+	}
+}
+
+func TestLogStorage(t *testing.T) {
+	ctx := context.Background()
+
+	store := setup(t)
+
+	queue := &Queue{Id: queueId, Config: &QueueConfig{Storage: "log"}}
+	store.SaveQueue(ctx, queue)
+
+	if store.SaveQueue(ctx, &Queue{Id: queueId, Config: &QueueConfig{}}) != ErrStorageChanged {
+		t.Error("Changed the storage of a queue")
+	}
+
+	if store.SaveMessage(ctx, queue, newMessage(messageId, messageContent)) != nil {
+		t.Error("Could not save message")
+	}
+
+	// The message goes to the queue's log, not through the folders.
+	if _, err := os.Stat(path.Join(store.NewFolder, queueId+":"+messageId)); err == nil {
+		t.Error("Found message file in 'new'")
+	}
+
+	if message, _ := store.FetchMessage(ctx, queue); message == nil || message.Id != messageId {
+		t.Fatal("Could not fetch message from the queue's log")
+	} else {
+		message.Body.Close()
+	}
+
+	if store.DeleteMessage(ctx, queue, &Message{Id: messageId}) != nil {
+		t.Error("Could not delete message")
+	}
+
+	store.DeleteQueue(ctx, queue)
+
+	if _, err := os.Stat(path.Join(store.LogFolder, queueId)); err == nil {
+		t.Error("Queue's log wasn't destroyed")
+	}
+}
+
+func TestMixedDeadLetters(t *testing.T) {
+	ctx := context.Background()
+
+	store := setup(t)
+
+	// A log queue whose dead letters go to a queue of files, and the other
+	// way around.
+	fileQueue := &Queue{Id: "files", Config: &QueueConfig{MaxReceiveCount: 1, DeadLetterQueue: "logged"}}
+	logQueue := &Queue{Id: "logged", Config: &QueueConfig{MaxReceiveCount: 1, DeadLetterQueue: "files", Storage: "log"}}
+
+	store.SaveQueue(ctx, fileQueue)
+	store.SaveQueue(ctx, logQueue)
+
+	store.SaveMessage(ctx, logQueue, newMessage(messageId, messageContent))
+
+	for i := 0; i < 2; i++ {
+		if fetched, _ := store.FetchMessage(ctx, logQueue); fetched != nil {
+			fetched.Body.Close()
+			store.ReleaseMessage(ctx, logQueue, fetched)
+		}
+	}
+
+	if messageIds, _ := store.ListMessages(ctx, logQueue); len(messageIds) != 0 {
+		t.Error("Message wasn't set aside:", messageIds)
+	}
+
+	// No mover runs, so the dead letter waits in 'new'.
+	newPath := path.Join(store.NewFolder, fileQueue.Id+":"+messageId)
+
+	if content, _ := ioutil.ReadFile(newPath); !bytes.Equal(content, messageContent) {
+		t.Fatal("Message wasn't saved to the file queue")
+	}
+
+	os.Rename(newPath, store.QueuePath(fileQueue, messageId))
+
+	for i := 0; i < 2; i++ {
+		if fetched, _ := store.FetchMessage(ctx, fileQueue); fetched != nil {
+			fetched.Body.Close()
+			store.ReleaseMessage(ctx, fileQueue, fetched)
+		}
+	}
+
+	if _, err := os.Stat(path.Join(store.DelayFolder, fileQueue.Id+":"+messageId)); err == nil {
+		t.Error("Found message file in 'delay'")
+	}
+
+	if messageIds, _ := store.ListMessages(ctx, logQueue); len(messageIds) != 1 || messageIds[0] != messageId {
+		t.Error("Message wasn't saved to the log queue:", messageIds)
+	}
+}
+
+func TestShardedQueue(t *testing.T) {
+	ctx := context.Background()
+
+	store := setup(t)
+	store.Shard = time.Hour
+
+	queue := &Queue{Id: queueId}
+	store.SaveQueue(ctx, queue)
+
+	// An old message, and one in the bucket new messages go into.
+	old := newMessage("00000000-0000-1000-8000-000000000000", messageContent)
+	current := newMessage(spool.TimeUUID(), messageContent)
+
+	for _, message := range []*Message{old, current} {
+		store.SaveMessage(ctx, queue, message)
+
+		// Simulate the mover delivering the new message.
+		if store.Deliver(path.Join(store.NewFolder, queueId+":"+message.Id), queue, message.Id) != nil {
+			t.Fatal("Could not deliver message to its bucket")
+		}
+	}
+
+	oldBucket := path.Join(store.QueuesFolder, queueId, spool.Bucket(old.Id, store.Shard))
+	currentBucket := path.Join(store.QueuesFolder, queueId, spool.Bucket(current.Id, store.Shard))
+
+	if messageIds, _ := store.ListMessages(ctx, queue); len(messageIds) != 2 {
+		t.Error("Could not list messages across buckets", messageIds)
+	}
 
-	teardown()
+	// The oldest bucket is fetched from first.
+	fetched, _ := store.FetchMessage(ctx, queue)
+
+	if fetched == nil || fetched.Id != old.Id {
+		t.Fatal("Did not fetch from the oldest bucket first")
+	}
+
+	fetched.Body.Close()
+
+	if message, _ := store.FetchMessage(ctx, queue); message == nil || message.Id != current.Id {
+		t.Fatal("Did not fetch from the next bucket")
+	} else {
+		message.Body.Close()
+	}
+
+	// The old bucket was left empty, and is gone. The current one stays.
+	if _, err := os.Stat(oldBucket); err == nil {
+		t.Error("Found empty bucket after fetching its messages")
+	}
+
+	if _, err := os.Stat(currentBucket); err != nil {
+		t.Error("Could not find the current bucket")
+	}
+
+	// A released message goes back into its bucket, which is created again.
+	if store.ReleaseMessage(ctx, queue, fetched) != nil {
+		t.Error("Could not release message into its bucket")
+	}
+
+	if _, err := os.Stat(path.Join(oldBucket, old.Id)); err != nil {
+		t.Error("Could not find released message in its bucket")
+	}
 }
 
 func BenchmarkMessageCreation(b *testing.B) {
-	store := setup()
+	ctx := context.Background()
+
+	store := setup(b)
 
 	queue := &Queue{Id: queueId}
-	store.SaveQueue(queue)
+	store.SaveQueue(ctx, queue)
 
 	for i := 0; i < b.N; i++ {
-		message := &Message{Id: TimeUUID(), Content: messageContent}
-		store.SaveMessage(queue, message)
+		message := newMessage(spool.TimeUUID(), messageContent)
+		store.SaveMessage(ctx, queue, message)
 	}
-
-	teardown()
 }